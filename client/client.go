@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/byronzhu-haha/chat/client/cmd"
+	"github.com/byronzhu-haha/log"
+	"os"
+)
+
+func main() {
+	client := cmd.NewChatClient(os.Stdin, os.Stdout)
+	if err := client.Run(); err != nil {
+		log.Errorf("client exit, err: %+v", err)
+		os.Exit(1)
+	}
+}
@@ -1,3 +1,599 @@
 package cmd
 
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/byronzhu-haha/chat/client/sdk"
+	"github.com/byronzhu-haha/chat/entity/group"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/entity/user"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
 
+var errQuit = errors.New("quit")
+
+type command struct {
+	usage string
+	help  string
+	run   func(c *ChatClient, ctx context.Context, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"register": {"register <name> <passwd>", "create an account, prints the new user id", (*ChatClient).register},
+		"login":    {"login <userid> <passwd>", "log in", (*ChatClient).login},
+		"logout":   {"logout", "log out", (*ChatClient).logout},
+		"search":   {"search <name|userid>", "search users by id or name", (*ChatClient).search},
+		"add":      {"add <userid>", "send a friend request", (*ChatClient).addFriend},
+		"accept":   {"accept <userid>", "accept a friend request", (*ChatClient).acceptFriend},
+		"reject":   {"reject <userid>", "reject a friend request", (*ChatClient).rejectFriend},
+		"cancel":   {"cancel <userid>", "withdraw a friend request", (*ChatClient).cancelFriend},
+		"requests": {"requests", "list pending friend requests", (*ChatClient).listFriendRequest},
+		"remove":   {"remove <userid>", "remove a friend", (*ChatClient).removeFriend},
+		"friends":  {"friends", "list friends", (*ChatClient).listFriend},
+		"send":     {"send <userid> <text...>", "send a chat message", (*ChatClient).send},
+		"group":    {"group <name>", "create a group joined by invitation, prints its id", (*ChatClient).createGroup},
+		"room":     {"room <name>", "create a room anyone can join, prints its id", (*ChatClient).createRoom},
+		"join":     {"join <groupid>", "join a room", (*ChatClient).joinGroup},
+		"leave":    {"leave <groupid>", "leave a group", (*ChatClient).leaveGroup},
+		"invite":   {"invite <groupid> <userid>", "invite a user into a group", (*ChatClient).inviteGroup},
+		"members":  {"members <groupid>", "list members of a group", (*ChatClient).listGroupMember},
+		"gsend":    {"gsend <groupid> <text...>", "send a chat message to a group", (*ChatClient).sendGroup},
+		"status":   {"status <state> [text...]", "set online, away, busy, dnd or invisible with a status text", (*ChatClient).status},
+		"block":    {"block <userid>", "stop a user from reaching you", (*ChatClient).block},
+		"unblock":  {"unblock <userid>", "unblock a user", (*ChatClient).unblock},
+		"blocked":  {"blocked", "list blocked users", (*ChatClient).listBlocked},
+		"privacy":  {"privacy [search|requests|presence <everyone|friends|nobody>]", "show or change who may find you, send you friend requests or see your presence", (*ChatClient).privacy},
+		"sessions": {"sessions", "list your sessions on all devices", (*ChatClient).listSessions},
+		"revoke":   {"revoke <deviceid>", "log out on another device", (*ChatClient).revokeSession},
+		"watch":    {"watch <userid>", "follow the state changes of a user", (*ChatClient).watch},
+		"unwatch":  {"unwatch <userid>", "stop following a user", (*ChatClient).unwatch},
+		"read":     {"read <msgid>", "tell the sender a message was read", (*ChatClient).read},
+		"history":  {"history <userid> [before]", "show messages with a user, before a message id", (*ChatClient).history},
+		"ghistory": {"ghistory <groupid> [before]", "show messages of a group, before a message id", (*ChatClient).groupHistory},
+		"help":     {"help", "show this help", (*ChatClient).help},
+		"quit":     {"quit", "exit the client", (*ChatClient).quit},
+	}
+}
+
+type ChatClient struct {
+	client *sdk.Client
+	in     io.Reader
+	out    io.Writer
+	outM   sync.Mutex
+}
+
+func NewChatClient(in io.Reader, out io.Writer) *ChatClient {
+	return &ChatClient{
+		client: sdk.New(),
+		in:     in,
+		out:    out,
+	}
+}
+
+func (c *ChatClient) Run() error {
+	err := c.client.Start()
+	if err != nil {
+		return err
+	}
+	defer c.client.Close()
+	go c.receive()
+
+	c.printf("connected, type help for commands\n")
+	scanner := bufio.NewScanner(c.in)
+	for c.prompt(); scanner.Scan(); c.prompt() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		cmd, ok := commands[fields[0]]
+		if !ok {
+			c.printf("unknown command %q, type help for commands\n", fields[0])
+			continue
+		}
+		err = cmd.run(c, context.Background(), fields[1:])
+		if err == errQuit {
+			return nil
+		}
+		if err != nil {
+			c.printf("%s: %v\n", fields[0], err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *ChatClient) prompt() {
+	c.printf("> ")
+}
+
+func (c *ChatClient) printf(format string, args ...interface{}) {
+	c.outM.Lock()
+	_, _ = fmt.Fprintf(c.out, format, args...)
+	c.outM.Unlock()
+}
+
+func (c *ChatClient) register(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return usageErr("register")
+	}
+	uid, err := c.client.Register(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	c.printf("registered, your user id is %s\n", uid)
+	return nil
+}
+
+func (c *ChatClient) login(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return usageErr("login")
+	}
+	err := c.client.Login(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	c.printf("logged in as %s\n", args[0])
+	return nil
+}
+
+func (c *ChatClient) logout(ctx context.Context, args []string) error {
+	err := c.client.Logout(ctx)
+	if err != nil {
+		return err
+	}
+	c.printf("logged out\n")
+	return nil
+}
+
+func (c *ChatClient) search(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("search")
+	}
+	users, err := c.client.SearchFriend(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	c.renderUsers(users)
+	return nil
+}
+
+func (c *ChatClient) addFriend(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("add")
+	}
+	users, err := c.client.MakeFriend(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	c.renderUsers(users)
+	return nil
+}
+
+func (c *ChatClient) acceptFriend(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("accept")
+	}
+	users, err := c.client.AcceptFriend(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	c.renderUsers(users)
+	return nil
+}
+
+func (c *ChatClient) rejectFriend(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("reject")
+	}
+	return c.client.RejectFriend(ctx, args[0])
+}
+
+func (c *ChatClient) cancelFriend(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("cancel")
+	}
+	return c.client.CancelFriend(ctx, args[0])
+}
+
+func (c *ChatClient) listFriendRequest(ctx context.Context, args []string) error {
+	reqs, err := c.client.ListFriendRequest(ctx)
+	if err != nil {
+		return err
+	}
+	c.printf("incoming: ")
+	c.renderUsers(reqs.Incoming)
+	c.printf("outgoing: ")
+	c.renderUsers(reqs.Outgoing)
+	return nil
+}
+
+func (c *ChatClient) removeFriend(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("remove")
+	}
+	users, err := c.client.DeleteFriend(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	c.renderUsers(users)
+	return nil
+}
+
+func (c *ChatClient) listFriend(ctx context.Context, args []string) error {
+	users, err := c.client.ListFriend(ctx)
+	if err != nil {
+		return err
+	}
+	c.renderUsers(users)
+	return nil
+}
+
+func (c *ChatClient) send(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return usageErr("send")
+	}
+	id, err := c.client.SendChat(ctx, args[0], strings.Join(args[1:], " "))
+	if err != nil {
+		return err
+	}
+	c.printf("sent #%d\n", id)
+	return nil
+}
+
+func (c *ChatClient) createGroup(ctx context.Context, args []string) error {
+	return c.create(ctx, "group", group.Private, args)
+}
+
+func (c *ChatClient) createRoom(ctx context.Context, args []string) error {
+	return c.create(ctx, "room", group.Room, args)
+}
+
+func (c *ChatClient) create(ctx context.Context, name string, kind group.Kind, args []string) error {
+	if len(args) != 1 {
+		return usageErr(name)
+	}
+	gid, err := c.client.CreateGroup(ctx, args[0], kind)
+	if err != nil {
+		return err
+	}
+	c.printf("created %s %s\n", kind, gid)
+	return nil
+}
+
+func (c *ChatClient) joinGroup(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("join")
+	}
+	err := c.client.JoinGroup(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	c.printf("joined %s\n", args[0])
+	return nil
+}
+
+func (c *ChatClient) leaveGroup(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("leave")
+	}
+	err := c.client.LeaveGroup(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	c.printf("left %s\n", args[0])
+	return nil
+}
+
+func (c *ChatClient) inviteGroup(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return usageErr("invite")
+	}
+	err := c.client.InviteGroup(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	c.printf("invited %s into %s\n", args[1], args[0])
+	return nil
+}
+
+func (c *ChatClient) listGroupMember(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("members")
+	}
+	users, err := c.client.ListGroupMember(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	c.renderUsers(users)
+	return nil
+}
+
+func (c *ChatClient) sendGroup(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return usageErr("gsend")
+	}
+	id, err := c.client.SendGroupChat(ctx, args[0], strings.Join(args[1:], " "))
+	if err != nil {
+		return err
+	}
+	c.printf("sent #%d\n", id)
+	return nil
+}
+
+func (c *ChatClient) status(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return usageErr("status")
+	}
+	state, ok := user.ParseState(args[0])
+	if !ok {
+		return usageErr("status")
+	}
+	return c.client.SetPresence(ctx, state, strings.Join(args[1:], " "))
+}
+
+func (c *ChatClient) block(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("block")
+	}
+	return c.client.Block(ctx, args[0])
+}
+
+func (c *ChatClient) unblock(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("unblock")
+	}
+	return c.client.Unblock(ctx, args[0])
+}
+
+func (c *ChatClient) listSessions(ctx context.Context, args []string) error {
+	sessions, err := c.client.Sessions(ctx)
+	if err != nil {
+		return err
+	}
+	c.outM.Lock()
+	defer c.outM.Unlock()
+	for _, s := range sessions {
+		mark := " "
+		if s.Current {
+			mark = "*"
+		}
+		since := time.Unix(0, s.Since*int64(time.Millisecond)).Format("01-02 15:04")
+		_, _ = fmt.Fprintf(c.out, "  %s %-16s %-16s %-21s since %s\n", mark, s.DeviceID, s.DeviceName, s.Addr, since)
+	}
+	return nil
+}
+
+func (c *ChatClient) revokeSession(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("revoke")
+	}
+	return c.client.RevokeSession(ctx, args[0])
+}
+
+func (c *ChatClient) listBlocked(ctx context.Context, args []string) error {
+	users, err := c.client.ListBlocked(ctx)
+	if err != nil {
+		return err
+	}
+	c.renderUsers(users)
+	return nil
+}
+
+func (c *ChatClient) privacy(ctx context.Context, args []string) error {
+	if len(args) != 0 && len(args) != 2 {
+		return usageErr("privacy")
+	}
+	p, err := c.client.Privacy(ctx)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		c.printf("search: %s, requests: %s, presence: %s\n", p.Search, p.FriendRequest, p.Presence)
+		return nil
+	}
+	a, ok := user.ParseAudience(args[1])
+	if !ok {
+		return usageErr("privacy")
+	}
+	switch args[0] {
+	case "search":
+		p.Search = a
+	case "requests":
+		p.FriendRequest = a
+	case "presence":
+		p.Presence = a
+	default:
+		return usageErr("privacy")
+	}
+	return c.client.SetPrivacy(ctx, p)
+}
+
+func (c *ChatClient) watch(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("watch")
+	}
+	p, err := c.client.SubscribePresence(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	c.printf("%s\n", presenceText(p))
+	return nil
+}
+
+func (c *ChatClient) unwatch(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("unwatch")
+	}
+	return c.client.UnsubscribePresence(ctx, args[0])
+}
+
+func (c *ChatClient) read(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usageErr("read")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return usageErr("read")
+	}
+	return c.client.MarkRead(id)
+}
+
+func (c *ChatClient) history(ctx context.Context, args []string) error {
+	return c.showHistory(ctx, "history", args, func(q *sdk.HistoryQuery, id string) { q.UserID = id })
+}
+
+func (c *ChatClient) groupHistory(ctx context.Context, args []string) error {
+	return c.showHistory(ctx, "ghistory", args, func(q *sdk.HistoryQuery, id string) { q.GroupID = id })
+}
+
+func (c *ChatClient) showHistory(ctx context.Context, name string, args []string, with func(q *sdk.HistoryQuery, id string)) error {
+	if len(args) < 1 || len(args) > 2 {
+		return usageErr(name)
+	}
+	var q sdk.HistoryQuery
+	with(&q, args[0])
+	if len(args) == 2 {
+		before, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return usageErr(name)
+		}
+		q.BeforeID = before
+	}
+	page, err := c.client.History(ctx, q)
+	if err != nil {
+		return err
+	}
+	c.outM.Lock()
+	defer c.outM.Unlock()
+	for _, m := range page.Messages {
+		t := time.Unix(0, m.Time*int64(time.Millisecond)).Format("2006-01-02 15:04:05")
+		_, _ = fmt.Fprintf(c.out, "  #%-6d %s %-12s %s\n", m.ID, t, m.SrcUserID, m.Body)
+	}
+	if page.More && len(page.Messages) > 0 {
+		_, _ = fmt.Fprintf(c.out, "  more: %s %s %d\n", name, args[0], page.Messages[0].ID)
+	}
+	return nil
+}
+
+func (c *ChatClient) help(ctx context.Context, args []string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.printf("  %-26s %s\n", commands[name].usage, commands[name].help)
+	}
+	return nil
+}
+
+func (c *ChatClient) quit(ctx context.Context, args []string) error {
+	return errQuit
+}
+
+func (c *ChatClient) receive() {
+	var lost bool
+	for {
+		select {
+		case <-c.client.Done():
+			c.printf("\nconnection closed\n")
+			return
+		case msg := <-c.client.Chats():
+			if msg.Synced {
+				to := msg.DestUserID
+				if msg.GroupID != "" {
+					to = "@" + msg.GroupID
+				}
+				c.printf("\n#%d [you -> %s] %s\n", msg.ID, to, msg.Text)
+			} else if msg.GroupID != "" {
+				c.printf("\n#%d [%s@%s] %s\n", msg.ID, msg.SrcUserID, msg.GroupID, msg.Text)
+			} else {
+				c.printf("\n#%d [%s] %s\n", msg.ID, msg.SrcUserID, msg.Text)
+			}
+			c.prompt()
+		case e := <-c.client.FriendEvents():
+			c.printf("\n* %s (%s) %s\n", e.Name, e.UserID, friendEventText(e.Event))
+			c.prompt()
+		case p := <-c.client.Presences():
+			c.printf("\n* %s\n", presenceText(p))
+			c.prompt()
+		case st := <-c.client.Statuses():
+			c.printf("\n#%d %s, user %s\n", st.MsgID, st.Status, st.UserID)
+			c.prompt()
+		case e := <-c.client.ConnEvents():
+			// being connected is worth telling only after a loss
+			if e.State == sdk.StateConnected && !lost || e.State == sdk.StateClosed {
+				continue
+			}
+			lost = e.State == sdk.StateReconnecting
+			c.printf("\n* %s\n", connEventText(e))
+			c.prompt()
+		}
+	}
+}
+
+func (c *ChatClient) renderUsers(users message.UserList) {
+	c.outM.Lock()
+	defer c.outM.Unlock()
+	_, _ = fmt.Fprintf(c.out, "%d user(s)\n", len(users))
+	for _, u := range users {
+		_, _ = fmt.Fprintf(c.out, "  %-12s %-20s %s\n", u.ID, u.Name, stateText(u.State, u.StatusText, u.LastSeen))
+	}
+}
+
+func connEventText(e sdk.ConnEvent) string {
+	switch e.State {
+	case sdk.StateConnected:
+		return "reconnected"
+	case sdk.StateReconnecting:
+		if e.Attempt == 0 {
+			return fmt.Sprintf("connection lost (%v), reconnecting", e.Err)
+		}
+		return fmt.Sprintf("reconnect attempt %d failed (%v)", e.Attempt, e.Err)
+	case sdk.StateSessionLost:
+		return fmt.Sprintf("reconnected, but the session is lost (%v), log in again", e.Err)
+	}
+	return e.State.String()
+}
+
+func friendEventText(e message.FriendEventType) string {
+	switch e {
+	case message.FriendRequested:
+		return "sent you a friend request"
+	case message.FriendAccepted:
+		return "accepted your friend request"
+	case message.FriendRejected:
+		return "rejected your friend request"
+	case message.FriendCanceled:
+		return "withdrew the friend request"
+	}
+	return e.String()
+}
+
+func presenceText(p message.Presence) string {
+	return p.UserID + " is " + stateText(p.State, p.StatusText, p.LastSeen)
+}
+
+func stateText(state user.State, text string, lastSeen int64) string {
+	res := state.String()
+	if text != "" {
+		res += " (" + text + ")"
+	}
+	if state == user.Offline && lastSeen > 0 {
+		res += ", last seen " + time.Unix(0, lastSeen*int64(time.Millisecond)).Format("2006-01-02 15:04")
+	}
+	return res
+}
+
+func usageErr(name string) error {
+	return fmt.Errorf("usage: %s", commands[name].usage)
+}
@@ -1,53 +1,387 @@
 package conn
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/byronzhu-haha/chat/client/config"
+	"github.com/byronzhu-haha/chat/entity/message"
 	"github.com/byronzhu-haha/log"
+	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type Conn struct {
+var (
+	ErrStopped      = errors.New("conn is stopped")
+	ErrDisconnected = errors.New("conn is lost, reconnecting")
+)
+
+// State is the state of the connection to the server.
+type State byte
+
+const (
+	// Connected is reported for the first connection and for every new one
+	// after a loss, once the handshake is done.
+	Connected State = iota
+	// Disconnected is reported when the connection is lost and after every
+	// failed attempt to reconnect; Conn keeps trying until it is stopped.
+	Disconnected
+	// Closed is the last state, reported after Stop.
+	Closed
+)
+
+func (s State) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Event is a change of the connection state. Attempt counts the failed
+// attempts to reconnect since the connection was lost, Err is why it was
+// lost or why the last attempt failed.
+type Event struct {
+	State   State
+	Attempt int
+	Err     error
+}
+
+const (
+	eventBufSize        = 100
+	defaultReconnectMin = 500 * time.Millisecond
+	defaultReconnectMax = 30 * time.Second
+)
+
+// link is one connection to the server; Conn replaces it after a loss.
+type link struct {
 	conn   net.Conn
+	framer *message.Framer
+	// wmu keeps the write deadline with the write it is set for
+	wmu sync.Mutex
+}
+
+// write writes the frame data within the Timeout of the config. A write that
+// fails, timing out in the middle of a frame maybe, closes the connection so
+// that the reader notices the loss.
+func (l *link) write(data []byte) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	var deadline time.Time
+	if timeout := time.Duration(config.DefaultConfig.Timeout) * time.Second; timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	_ = l.conn.SetWriteDeadline(deadline)
+	err := l.framer.WriteFrame(data)
+	if err != nil {
+		_ = l.conn.Close()
+	}
+	return err
+}
+
+// Conn is the connection to the server. Once started it reconnects with
+// exponential backoff whenever the connection is lost, until it is stopped;
+// the frames of all connections arrive on the same channel.
+type Conn struct {
+	mu     sync.RWMutex
+	link   *link
+	caps   message.Capability
+	codec  message.Codec
 	reader chan []byte
+	events chan Event
 	stopCh chan struct{}
+	stop   sync.Once
+	// lastRead is the time in unix nanoseconds the last frame was read
+	lastRead int64
 }
 
 func NewConn() *Conn {
 	return &Conn{
+		codec:  message.GobCodec,
 		reader: make(chan []byte, 1000),
+		events: make(chan Event, eventBufSize),
 		stopCh: make(chan struct{}),
 	}
 }
 
 func (c *Conn) Start() error {
-	conn, err := net.DialTimeout("tcp", config.DefaultConfig.ServerAddr, time.Second*3)
+	l, err := c.connect()
 	if err != nil {
 		return err
 	}
-	c.conn = conn
-	c.work()
+	if !c.setLink(l) {
+		return ErrStopped
+	}
+	c.emit(Event{State: Connected})
+	go c.run(l)
 	return nil
 }
 
-func (c *Conn) work() {
-	go func() {
-		for {
-			select {
-			case <-c.stopCh:
-				log.Infof("stop read data...")
-				return
-			default:
-				var data []byte
-				_, err := c.conn.Read(data)
-				if err != nil {
-					log.Errorf("read data failed, err: %+v", err)
-					continue
-				}
-				c.reader <- data
+func (c *Conn) connect() (*link, error) {
+	conn, err := dial(config.DefaultConfig)
+	if err != nil {
+		return nil, err
+	}
+	l := &link{conn: conn, framer: message.NewFramer(conn, message.DefaultMaxFrameSize)}
+	err = c.handshake(l)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func dial(cfg *config.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Duration(cfg.Timeout) * time.Second}
+	if !cfg.TLS {
+		return dialer.Dial("tcp", cfg.ServerAddr)
+	}
+	tc, err := loadTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", cfg.ServerAddr, tc)
+}
+
+func (c *Conn) handshake(l *link) error {
+	codec, err := message.CodecByName(config.DefaultConfig.Codec)
+	if err != nil {
+		return err
+	}
+	caps := message.CodecCapability(codec) | message.CapAck
+	if config.DefaultConfig.Compress {
+		caps |= message.CapCompression
+	}
+	body, err := message.PackHandshake(message.ProtocolVersion, config.DefaultConfig.ClientName, caps)
+	if err != nil {
+		return err
+	}
+	hello, err := message.Pack(message.HandshakeCodec, message.MsgTypeHandshake, nil, body)
+	if err != nil {
+		return err
+	}
+	err = l.write(hello)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(config.DefaultConfig.Timeout) * time.Second
+	_ = l.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer l.conn.SetReadDeadline(time.Time{})
+	data, err := l.framer.ReadFrame()
+	if err != nil {
+		return err
+	}
+	msg, err := message.Unpack(message.HandshakeCodec, data)
+	if err != nil {
+		return err
+	}
+	if !msg.IsHandshakeMsg() {
+		return errors.New("server did not answer handshake")
+	}
+	ack, err := message.UnpackHandshakeAck(msg.Body)
+	if err != nil {
+		return err
+	}
+	if ack.Code != message.CodeOk {
+		return fmt.Errorf("handshake rejected, server version: %d, code: %d", ack.Version, ack.Code)
+	}
+	if ack.Capabilities.Has(message.CapCompression) {
+		l.framer.EnableCompression()
+	}
+	c.mu.Lock()
+	c.caps = ack.Capabilities
+	c.codec = ack.Capabilities.Codec()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) Capabilities() message.Capability {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.caps
+}
+
+// LocalAddr is the local address of the current connection, empty while
+// reconnecting.
+func (c *Conn) LocalAddr() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.link == nil {
+		return ""
+	}
+	return c.link.conn.LocalAddr().String()
+}
+
+// Codec is the codec agreed on in the handshake; every message sent or
+// received after Start must be packed and unpacked with it.
+func (c *Conn) Codec() message.Codec {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.codec
+}
+
+// Events reports the changes of the connection state. Events are dropped
+// when the channel is full; it is closed after Closed.
+func (c *Conn) Events() <-chan Event {
+	return c.events
+}
+
+// run reads from l and from every connection replacing it until the
+// connection is stopped.
+func (c *Conn) run(l *link) {
+	defer func() {
+		close(c.reader)
+		c.emit(Event{State: Closed})
+		close(c.events)
+	}()
+	for {
+		err := c.read(l)
+		c.setLink(nil)
+		_ = l.conn.Close()
+		if c.stopped() {
+			return
+		}
+		log.Warnf("connection to server lost, err: %+v", err)
+		c.emit(Event{State: Disconnected, Err: err})
+		l = c.reconnect()
+		if l == nil || !c.setLink(l) {
+			return
+		}
+		c.emit(Event{State: Connected})
+	}
+}
+
+// reconnect dials the server until it succeeds or the connection is stopped,
+// in which case it returns nil.
+func (c *Conn) reconnect() *link {
+	cfg := config.DefaultConfig
+	b := backoff{
+		min: time.Duration(cfg.ReconnectMin) * time.Millisecond,
+		max: time.Duration(cfg.ReconnectMax) * time.Millisecond,
+	}
+	if b.min <= 0 {
+		b.min = defaultReconnectMin
+	}
+	if b.max < b.min {
+		b.max = defaultReconnectMax
+	}
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.stopCh:
+			return nil
+		case <-time.After(b.next()):
+		}
+		l, err := c.connect()
+		if err == nil {
+			log.Infof("reconnected to server after %d attempt(s)", attempt)
+			return l
+		}
+		log.Warnf("reconnect to server failed, attempt: %d, err: %+v", attempt, err)
+		c.emit(Event{State: Disconnected, Attempt: attempt, Err: err})
+	}
+}
+
+// backoff doubles the delay between attempts from min up to max. Each delay
+// is drawn from its upper half so that clients cut off together do not all
+// come back at the same time.
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+}
+
+func (b *backoff) next() time.Duration {
+	switch {
+	case b.cur == 0:
+		b.cur = b.min
+	case b.cur < b.max:
+		b.cur *= 2
+	}
+	if b.cur > b.max {
+		b.cur = b.max
+	}
+	half := b.cur / 2
+	return half + time.Duration(rand.Int63n(int64(b.cur-half)+1))
+}
+
+// setLink makes l the current connection; it reports false, closing l, if
+// the connection was stopped meanwhile.
+func (c *Conn) setLink(l *link) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if l != nil && c.stopped() {
+		_ = l.conn.Close()
+		return false
+	}
+	c.link = l
+	return true
+}
+
+// read passes the frames of l on to the reader until reading fails.
+func (c *Conn) read(l *link) error {
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	for {
+		select {
+		case <-c.stopCh:
+			log.Infof("stop read data...")
+			return ErrStopped
+		default:
+		}
+		c.setReadDeadline(l)
+		data, err := l.framer.ReadFrame()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && c.heartbeat() {
+				continue
 			}
+			return err
 		}
-	}()
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+		select {
+		case <-c.stopCh:
+			return ErrStopped
+		case c.reader <- data:
+		}
+	}
+}
+
+// setReadDeadline wakes the reader up after a heartbeat interval to check on
+// the connection, if heartbeats are on.
+func (c *Conn) setReadDeadline(l *link) {
+	every := time.Duration(config.DefaultConfig.Heartbeat) * time.Second
+	if every <= 0 {
+		_ = l.conn.SetReadDeadline(time.Time{})
+		return
+	}
+	_ = l.conn.SetReadDeadline(time.Now().Add(every))
+}
+
+// heartbeat pings the server after the connection was quiet for a heartbeat
+// interval and reports false once it was quiet for longer than the
+// IdleTimeout of the config.
+func (c *Conn) heartbeat() bool {
+	quiet := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead)))
+	limit := time.Duration(config.DefaultConfig.IdleTimeout) * time.Second
+	if limit > 0 && quiet > limit {
+		log.Warnf("server has been quiet for %s, give the connection up", quiet)
+		return false
+	}
+	ping, err := message.PackPing(c.Codec())
+	if err != nil {
+		log.Errorf("pack ping failed, err: %+v", err)
+		return true
+	}
+	err = c.Send(ping)
+	if err != nil {
+		log.Errorf("send ping failed, err: %+v", err)
+	}
+	return true
 }
 
 func (c *Conn) ReceiveMsg() <-chan []byte {
@@ -69,20 +403,53 @@ func (c *Conn) ReceiveMsg() <-chan []byte {
 
 func (c *Conn) SendMsg(msg []byte) {
 	go func() {
-		select {
-		case <-c.stopCh:
-			return
-		default:
-			_, err := c.conn.Write(msg)
-			if err != nil {
-				log.Errorf("send message failed, err: %+v", err)
-				return
-			}
+		err := c.Send(msg)
+		if err != nil {
+			log.Errorf("send message failed, err: %+v", err)
 		}
 	}()
 }
 
+// Send writes msg synchronously, unlike SendMsg. It fails with
+// ErrDisconnected while the connection is being reestablished.
+func (c *Conn) Send(msg []byte) error {
+	if c.stopped() {
+		return ErrStopped
+	}
+	c.mu.RLock()
+	l := c.link
+	c.mu.RUnlock()
+	if l == nil {
+		return ErrDisconnected
+	}
+	return l.write(msg)
+}
+
+func (c *Conn) emit(e Event) {
+	select {
+	case c.events <- e:
+	default:
+		log.Warnf("event buffer is full, drop %s event", e.State)
+	}
+}
+
+func (c *Conn) stopped() bool {
+	select {
+	case <-c.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop closes the connection for good.
 func (c *Conn) Stop() {
-	_ = c.conn.Close()
-	close(c.stopCh)
+	c.stop.Do(func() {
+		close(c.stopCh)
+		c.mu.Lock()
+		if c.link != nil {
+			_ = c.link.conn.Close()
+		}
+		c.mu.Unlock()
+	})
 }
@@ -0,0 +1,35 @@
+package conn
+
+import (
+	"github.com/byronzhu-haha/chat/client/config"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteDeadline(t *testing.T) {
+	saved := *config.DefaultConfig
+	defer func() {
+		*config.DefaultConfig = saved
+	}()
+	config.DefaultConfig.Timeout = 1
+
+	// nobody reads from the server end, the write can not complete
+	client, server := net.Pipe()
+	defer server.Close()
+	l := &link{conn: client, framer: message.NewFramer(client, message.DefaultMaxFrameSize)}
+	start := time.Now()
+	err := l.write([]byte("hello"))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("write to a stuck peer, err: %v", err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Fatalf("write gave up after %s", d)
+	}
+
+	// the frame may be cut off, the connection is not written to again
+	if err = l.write([]byte("hello")); err == nil {
+		t.Fatal("write after a timeout succeeded")
+	}
+}
@@ -0,0 +1,75 @@
+package conn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/byronzhu-haha/chat/client/config"
+	"net"
+	"os"
+	"strings"
+)
+
+func loadTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName: cfg.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tc.ServerName == "" {
+		host, _, err := net.SplitHostPort(cfg.ServerAddr)
+		if err != nil {
+			return nil, err
+		}
+		tc.ServerName = host
+	}
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.TLSCAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.TLSPinSHA256 != "" {
+		pin, err := hex.DecodeString(strings.ReplaceAll(cfg.TLSPinSHA256, ":", ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls pin, err: %w", err)
+		}
+		// without a CA the pin alone identifies the server, e.g. a self-signed cert
+		tc.InsecureSkipVerify = cfg.TLSCAFile == ""
+		tc.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPin(rawCerts, pin)
+		}
+	}
+	return tc, nil
+}
+
+// verifyPin checks the SHA-256 of the server leaf certificate's public key.
+func verifyPin(rawCerts [][]byte, pin []byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	if !bytes.Equal(sum[:], pin) {
+		return errors.New("server public key does not match pinned key")
+	}
+	return nil
+}
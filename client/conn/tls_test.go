@@ -0,0 +1,223 @@
+package conn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"github.com/byronzhu-haha/chat/client/config"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+// issue creates a certificate for name signed by parent, or a self-signed CA
+// when parent is nil.
+func issue(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert},
+	}
+}
+
+// write stores the certificate and key of c as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) pin() string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// serve accepts one connection with cfg and returns the address to dial and
+// the error of the server side handshake.
+func serve(t *testing.T, cfg *tls.Config) (string, <-chan error) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		err = c.(*tls.Conn).Handshake()
+		if err == nil {
+			_, err = c.Write([]byte{1})
+		}
+		done <- err
+	}()
+	return ln.Addr().String(), done
+}
+
+// dialTLS connects to a fresh server using the client config cfg, it returns
+// the errors of both sides.
+func dialTLS(t *testing.T, server *tls.Config, cfg *config.Config) (serverErr, clientErr error) {
+	t.Helper()
+	addr, done := serve(t, server)
+	cfg.ServerAddr = addr
+	tc, err := loadTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := tls.Dial("tcp", addr, tc)
+	if err == nil {
+		_, err = c.Read(make([]byte, 1))
+		c.Close()
+	}
+	if err != nil {
+		// the server may still wait for a client that gave up
+		return nil, err
+	}
+	return <-done, nil
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "ca", nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	server := issue(t, "localhost", ca)
+	serverCfg := &tls.Config{Certificates: []tls.Certificate{server.pair}}
+
+	t.Run("ca", func(t *testing.T) {
+		serverErr, clientErr := dialTLS(t, serverCfg, &config.Config{TLSServerName: "localhost", TLSCAFile: caFile})
+		if serverErr != nil || clientErr != nil {
+			t.Fatalf("server: %v, client: %v", serverErr, clientErr)
+		}
+		// the system roots do not know the test ca
+		if _, clientErr = dialTLS(t, serverCfg, &config.Config{TLSServerName: "localhost"}); clientErr == nil {
+			t.Fatal("certificate of an unknown ca accepted")
+		}
+		// the server name defaults to the host of the server address
+		if _, clientErr = dialTLS(t, serverCfg, &config.Config{TLSCAFile: caFile}); clientErr != nil {
+			t.Fatalf("dial by address: %v", clientErr)
+		}
+	})
+
+	t.Run("client certificate", func(t *testing.T) {
+		certFile, keyFile := issue(t, "client", ca).write(t, dir, "client")
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		mutual := &tls.Config{
+			Certificates: []tls.Certificate{server.pair},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}
+		serverErr, clientErr := dialTLS(t, mutual, &config.Config{
+			TLSServerName: "localhost",
+			TLSCAFile:     caFile,
+			TLSCertFile:   certFile,
+			TLSKeyFile:    keyFile,
+		})
+		if serverErr != nil || clientErr != nil {
+			t.Fatalf("server: %v, client: %v", serverErr, clientErr)
+		}
+		if _, clientErr = dialTLS(t, mutual, &config.Config{TLSServerName: "localhost", TLSCAFile: caFile}); clientErr == nil {
+			t.Fatal("server accepted a client without a certificate")
+		}
+	})
+
+	t.Run("pin", func(t *testing.T) {
+		self := issue(t, "localhost", nil)
+		selfCfg := &tls.Config{Certificates: []tls.Certificate{self.pair}}
+		serverErr, clientErr := dialTLS(t, selfCfg, &config.Config{TLSPinSHA256: self.pin()})
+		if serverErr != nil || clientErr != nil {
+			t.Fatalf("server: %v, client: %v", serverErr, clientErr)
+		}
+		if _, clientErr = dialTLS(t, selfCfg, &config.Config{TLSPinSHA256: server.pin()}); clientErr == nil {
+			t.Fatal("self-signed certificate with another key accepted")
+		}
+		// with a ca the chain is verified as well as the pin
+		if _, clientErr = dialTLS(t, selfCfg, &config.Config{TLSCAFile: caFile, TLSPinSHA256: self.pin()}); clientErr == nil {
+			t.Fatal("pinned certificate outside the ca accepted")
+		}
+		if _, err := loadTLSConfig(&config.Config{ServerAddr: "127.0.0.1:1", TLSPinSHA256: "not hex"}); err == nil {
+			t.Fatal("invalid pin accepted")
+		}
+	})
+}
+
+func TestVerifyPin(t *testing.T) {
+	cert := issue(t, "localhost", nil)
+	other := issue(t, "localhost", nil)
+	pin, _ := hex.DecodeString(cert.pin())
+
+	if err := verifyPin([][]byte{cert.cert.Raw}, pin); err != nil {
+		t.Fatalf("match: %v", err)
+	}
+	// only the leaf is pinned, not the rest of the chain
+	if err := verifyPin([][]byte{other.cert.Raw, cert.cert.Raw}, pin); err == nil {
+		t.Fatal("mismatched leaf accepted")
+	}
+	if err := verifyPin(nil, pin); err == nil {
+		t.Fatal("empty chain accepted")
+	}
+	if err := verifyPin([][]byte{[]byte("garbage")}, pin); err == nil {
+		t.Fatal("unparsable certificate accepted")
+	}
+}
@@ -0,0 +1,70 @@
+package sdk
+
+import (
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/log"
+)
+
+// Status tells that the message MsgID sent by this client was delivered to
+// or read by UserID.
+type Status struct {
+	MsgID   int64
+	UserID  string
+	GroupID string
+	Status  message.AckStatus
+}
+
+// Statuses delivers the delivered acks and read receipts of sent messages.
+// Like Chats it drops them when full.
+func (c *Client) Statuses() <-chan Status {
+	return c.statuses
+}
+
+// MarkRead sends a read receipt for the received message msgID to its
+// sender.
+func (c *Client) MarkRead(msgID int64) error {
+	if c.UserID() == "" {
+		return ErrNotLoggedIn
+	}
+	return c.sendAck(message.MsgTypeReceipt, message.Ack{Status: message.AckRead, MsgID: msgID})
+}
+
+func (c *Client) sendAck(msgType message.MsgType, ack message.Ack) error {
+	if !c.conn.Capabilities().Has(message.CapAck) {
+		// the server takes no acks
+		return nil
+	}
+	codec := c.conn.Codec()
+	body, err := message.PackAck(codec, &ack)
+	if err != nil {
+		return err
+	}
+	msg, err := message.Pack(codec, msgType, nil, body)
+	if err != nil {
+		return err
+	}
+	return c.conn.Send(msg)
+}
+
+// onAck answers a pending send with the accepted or rejected ack of the
+// server, which ends the replays of the message, and passes delivered acks and read receipts on to Statuses.
+func (c *Client) onAck(codec message.Codec, msg message.Message) {
+	ack, err := message.UnpackAck(codec, msg.Body)
+	if err != nil {
+		log.Errorf("unpack ack failed, err: %+v", err)
+		return
+	}
+	switch ack.Status {
+	case message.AckAccepted, message.AckRejected:
+		c.mu.Lock()
+		delete(c.unacked, ack.Seq)
+		c.mu.Unlock()
+		c.answer(ack.Seq, msg)
+		return
+	}
+	select {
+	case c.statuses <- Status{MsgID: ack.MsgID, UserID: ack.UserID, GroupID: ack.GroupID, Status: ack.Status}:
+	default:
+		log.Warnf("status buffer is full, drop %s of message %d", ack.Status, ack.MsgID)
+	}
+}
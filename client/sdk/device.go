@@ -0,0 +1,60 @@
+package sdk
+
+import (
+	"context"
+	"github.com/byronzhu-haha/chat/client/config"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"os"
+)
+
+// device is what this client tells the server about itself on login, so the
+// user can tell their sessions apart.
+type device struct {
+	id   string
+	name string
+}
+
+func defaultDevice() device {
+	d := device{id: config.DefaultConfig.DeviceID, name: config.DefaultConfig.DeviceName}
+	if d.name == "" {
+		d.name, _ = os.Hostname()
+	}
+	return d
+}
+
+// DeviceID is the id of this device, assigned by the server on the first
+// login unless it is configured.
+func (c *Client) DeviceID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.device.id
+}
+
+// Sessions lists the sessions of this user on all their devices.
+func (c *Client) Sessions(ctx context.Context) (message.SessionList, error) {
+	if c.UserID() == "" {
+		return nil, ErrNotLoggedIn
+	}
+	body, err := c.call(ctx, message.ServerMetadata{
+		Operate: message.OperateTypeListSessions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list message.SessionList
+	err = list.Unmarshal(c.conn.Codec(), body)
+	return list, err
+}
+
+// RevokeSession logs this user out on the device deviceID, which can not
+// resume the session then. Use Logout to end the session of this device.
+func (c *Client) RevokeSession(ctx context.Context, deviceID string) error {
+	if c.UserID() == "" {
+		return ErrNotLoggedIn
+	}
+	_, err := c.call(ctx, message.ServerMetadata{
+		Operate:  message.OperateTypeRevokeSession,
+		DeviceID: deviceID,
+	})
+	return err
+}
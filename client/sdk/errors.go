@@ -0,0 +1,43 @@
+package sdk
+
+import (
+	"errors"
+	"fmt"
+	"github.com/byronzhu-haha/chat/entity/message"
+)
+
+var (
+	ErrFailed              = errors.New("request failed")
+	ErrServerTimeout       = errors.New("request timed out on server")
+	ErrInvalidOperate      = errors.New("invalid operate")
+	ErrIncompatibleVersion = errors.New("incompatible protocol version")
+	ErrWeakPassword        = errors.New("password does not satisfy the policy")
+	ErrUnauthorized        = errors.New("unauthorized")
+	ErrForbidden           = errors.New("forbidden")
+	ErrClosed              = errors.New("client is closed")
+	ErrNotLoggedIn         = errors.New("not logged in")
+	ErrDisconnected        = errors.New("connection lost")
+	ErrTooManyUnacked      = errors.New("too many messages waiting for an ack")
+)
+
+var codeErrors = map[message.Code]error{
+	message.CodeFailed:              ErrFailed,
+	message.CodeTimeout:             ErrServerTimeout,
+	message.CodeInvalidOperate:      ErrInvalidOperate,
+	message.CodeIncompatibleVersion: ErrIncompatibleVersion,
+	message.CodeWeakPassword:        ErrWeakPassword,
+	message.CodeUnauthorized:        ErrUnauthorized,
+	message.CodeForbidden:           ErrForbidden,
+}
+
+// CodeError maps a response code to the error returned by the client methods,
+// nil for CodeOk. Use errors.Is to test for a specific code.
+func CodeError(code message.Code) error {
+	if code == message.CodeOk {
+		return nil
+	}
+	if err, ok := codeErrors[code]; ok {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrFailed, code)
+}
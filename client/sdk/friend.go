@@ -0,0 +1,67 @@
+package sdk
+
+import (
+	"context"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/log"
+)
+
+// FriendEvents delivers friend requests to this user and the answers to the
+// requests of this user. Like Chats it drops them when full.
+func (c *Client) FriendEvents() <-chan message.FriendEvent {
+	return c.friendEvents
+}
+
+// AcceptFriend accepts the pending friend request of userid and returns the
+// friends after that.
+func (c *Client) AcceptFriend(ctx context.Context, userid string) (message.UserList, error) {
+	return c.friendCall(ctx, message.OperateTypeAcceptFriend, userid)
+}
+
+func (c *Client) RejectFriend(ctx context.Context, userid string) error {
+	return c.answerFriend(ctx, message.OperateTypeRejectFriend, userid)
+}
+
+// CancelFriend withdraws the friend request sent to userid.
+func (c *Client) CancelFriend(ctx context.Context, userid string) error {
+	return c.answerFriend(ctx, message.OperateTypeCancelFriend, userid)
+}
+
+func (c *Client) answerFriend(ctx context.Context, op message.OperateType, userid string) error {
+	if c.UserID() == "" {
+		return ErrNotLoggedIn
+	}
+	_, err := c.call(ctx, message.ServerMetadata{
+		Operate:    op,
+		DestUserID: userid,
+	})
+	return err
+}
+
+func (c *Client) ListFriendRequest(ctx context.Context) (message.FriendRequests, error) {
+	var reqs message.FriendRequests
+	if c.UserID() == "" {
+		return reqs, ErrNotLoggedIn
+	}
+	body, err := c.call(ctx, message.ServerMetadata{
+		Operate: message.OperateTypeListFriendRequest,
+	})
+	if err != nil {
+		return reqs, err
+	}
+	err = reqs.Unmarshal(c.conn.Codec(), body)
+	return reqs, err
+}
+
+func (c *Client) onFriend(codec message.Codec, msg message.Message) {
+	e, err := message.UnpackFriendEvent(codec, msg.Body)
+	if err != nil {
+		log.Errorf("unpack friend event failed, err: %+v", err)
+		return
+	}
+	select {
+	case c.friendEvents <- e:
+	default:
+		log.Warnf("friend event buffer is full, drop %s of %s", e.Event, e.UserID)
+	}
+}
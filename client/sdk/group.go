@@ -0,0 +1,63 @@
+package sdk
+
+import (
+	"context"
+	"github.com/byronzhu-haha/chat/entity/group"
+	"github.com/byronzhu-haha/chat/entity/message"
+)
+
+// CreateGroup creates a group owned by the logged in user and returns its
+// id. Rooms are open to anyone, other groups are joined by invitation.
+func (c *Client) CreateGroup(ctx context.Context, name string, kind group.Kind) (groupID string, err error) {
+	body, err := c.groupCall(ctx, message.ServerMetadata{
+		Operate:   message.OperateTypeCreateGroup,
+		GroupName: name,
+		GroupKind: kind,
+	})
+	return string(body), err
+}
+
+func (c *Client) JoinGroup(ctx context.Context, groupID string) error {
+	_, err := c.groupCall(ctx, message.ServerMetadata{
+		Operate: message.OperateTypeJoinGroup,
+		GroupID: groupID,
+	})
+	return err
+}
+
+func (c *Client) LeaveGroup(ctx context.Context, groupID string) error {
+	_, err := c.groupCall(ctx, message.ServerMetadata{
+		Operate: message.OperateTypeLeaveGroup,
+		GroupID: groupID,
+	})
+	return err
+}
+
+func (c *Client) InviteGroup(ctx context.Context, groupID, userid string) error {
+	_, err := c.groupCall(ctx, message.ServerMetadata{
+		Operate:    message.OperateTypeInviteGroup,
+		GroupID:    groupID,
+		DestUserID: userid,
+	})
+	return err
+}
+
+func (c *Client) ListGroupMember(ctx context.Context, groupID string) (message.UserList, error) {
+	body, err := c.groupCall(ctx, message.ServerMetadata{
+		Operate: message.OperateTypeListGroupMember,
+		GroupID: groupID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var users message.UserList
+	err = users.Unmarshal(c.conn.Codec(), body)
+	return users, err
+}
+
+func (c *Client) groupCall(ctx context.Context, meta message.ServerMetadata) ([]byte, error) {
+	if c.UserID() == "" {
+		return nil, ErrNotLoggedIn
+	}
+	return c.call(ctx, meta)
+}
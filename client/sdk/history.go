@@ -0,0 +1,38 @@
+package sdk
+
+import (
+	"context"
+	"github.com/byronzhu-haha/chat/entity/message"
+)
+
+// HistoryQuery selects a page of the conversation with UserID, or of the
+// group GroupID if that is set. With AfterID set the page holds the messages
+// following it, otherwise the ones preceding BeforeID, or the latest ones if
+// that is 0 too. Limit defaults to a server chosen page size.
+type HistoryQuery struct {
+	UserID   string
+	GroupID  string
+	BeforeID int64
+	AfterID  int64
+	Limit    int
+}
+
+func (c *Client) History(ctx context.Context, q HistoryQuery) (message.HistoryPage, error) {
+	var page message.HistoryPage
+	if c.UserID() == "" {
+		return page, ErrNotLoggedIn
+	}
+	body, err := c.call(ctx, message.ServerMetadata{
+		Operate:    message.OperateTypeHistory,
+		DestUserID: q.UserID,
+		GroupID:    q.GroupID,
+		BeforeID:   q.BeforeID,
+		AfterID:    q.AfterID,
+		Limit:      q.Limit,
+	})
+	if err != nil {
+		return page, err
+	}
+	err = page.Unmarshal(c.conn.Codec(), body)
+	return page, err
+}
@@ -0,0 +1,79 @@
+package sdk
+
+import (
+	"context"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/entity/user"
+	"github.com/byronzhu-haha/log"
+)
+
+// Presences delivers the state changes of friends and of the users
+// subscribed to. Like Chats it drops them when full.
+func (c *Client) Presences() <-chan message.Presence {
+	return c.presences
+}
+
+// SubscribePresence asks for the state changes of userid, who need not be a
+// friend, until UnsubscribePresence or the end of the session. It returns
+// the current state of userid.
+func (c *Client) SubscribePresence(ctx context.Context, userid string) (message.Presence, error) {
+	var p message.Presence
+	if c.UserID() == "" {
+		return p, ErrNotLoggedIn
+	}
+	body, err := c.call(ctx, message.ServerMetadata{
+		Operate:    message.OperateTypeSubscribePresence,
+		DestUserID: userid,
+	})
+	if err != nil {
+		return p, err
+	}
+	c.mu.Lock()
+	c.watching[userid] = struct{}{}
+	c.mu.Unlock()
+	return message.UnpackPresence(c.conn.Codec(), body)
+}
+
+func (c *Client) UnsubscribePresence(ctx context.Context, userid string) error {
+	if c.UserID() == "" {
+		return ErrNotLoggedIn
+	}
+	_, err := c.call(ctx, message.ServerMetadata{
+		Operate:    message.OperateTypeUnsubscribePresence,
+		DestUserID: userid,
+	})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.watching, userid)
+	c.mu.Unlock()
+	return nil
+}
+
+// SetPresence sets the state and the status text others see; Invisible shows
+// the user as offline while staying logged in.
+func (c *Client) SetPresence(ctx context.Context, state user.State, text string) error {
+	if c.UserID() == "" {
+		return ErrNotLoggedIn
+	}
+	_, err := c.call(ctx, message.ServerMetadata{
+		Operate:    message.OperateTypeSetPresence,
+		State:      state,
+		StatusText: text,
+	})
+	return err
+}
+
+func (c *Client) onPresence(codec message.Codec, msg message.Message) {
+	p, err := message.UnpackPresence(codec, msg.Body)
+	if err != nil {
+		log.Errorf("unpack presence failed, err: %+v", err)
+		return
+	}
+	select {
+	case c.presences <- p:
+	default:
+		log.Warnf("presence buffer is full, drop state of %s", p.UserID)
+	}
+}
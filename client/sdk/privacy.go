@@ -0,0 +1,64 @@
+package sdk
+
+import (
+	"context"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/entity/user"
+)
+
+// Block stops userid from messaging this user, sending friend requests or
+// group invitations to them and from finding them or seeing their presence.
+// It also ends the friendship with userid.
+func (c *Client) Block(ctx context.Context, userid string) error {
+	return c.blockCall(ctx, message.OperateTypeBlock, userid)
+}
+
+func (c *Client) Unblock(ctx context.Context, userid string) error {
+	return c.blockCall(ctx, message.OperateTypeUnblock, userid)
+}
+
+func (c *Client) blockCall(ctx context.Context, op message.OperateType, userid string) error {
+	if c.UserID() == "" {
+		return ErrNotLoggedIn
+	}
+	_, err := c.call(ctx, message.ServerMetadata{
+		Operate:    op,
+		DestUserID: userid,
+	})
+	return err
+}
+
+func (c *Client) ListBlocked(ctx context.Context) (message.UserList, error) {
+	if c.UserID() == "" {
+		return nil, ErrNotLoggedIn
+	}
+	return c.callUsers(ctx, message.ServerMetadata{
+		Operate: message.OperateTypeListBlocked,
+	})
+}
+
+// SetPrivacy sets who may find this user, send them friend requests and see
+// their presence. Friend requests are open to either everyone or nobody.
+func (c *Client) SetPrivacy(ctx context.Context, p user.Privacy) error {
+	if c.UserID() == "" {
+		return ErrNotLoggedIn
+	}
+	_, err := c.call(ctx, message.ServerMetadata{
+		Operate: message.OperateTypeSetPrivacy,
+		Privacy: p,
+	})
+	return err
+}
+
+func (c *Client) Privacy(ctx context.Context) (user.Privacy, error) {
+	if c.UserID() == "" {
+		return user.Privacy{}, ErrNotLoggedIn
+	}
+	body, err := c.call(ctx, message.ServerMetadata{
+		Operate: message.OperateTypeGetPrivacy,
+	})
+	if err != nil {
+		return user.Privacy{}, err
+	}
+	return message.UnpackPrivacy(c.conn.Codec(), body)
+}
@@ -0,0 +1,496 @@
+package sdk
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/byronzhu-haha/chat/client/config"
+	"github.com/byronzhu-haha/chat/client/conn"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	chatBufSize = 1000
+	// maxUnacked bounds the chat messages waiting for an ack of the server
+	maxUnacked = 1000
+)
+
+// ChatMessage is a chat message received from SrcUserID, sent to the group
+// GroupID if that is set. Synced marks a message this user sent on another
+// device.
+type ChatMessage struct {
+	ID         int64
+	SrcUserID  string
+	DestUserID string
+	GroupID    string
+	Text       string
+	Time       time.Time
+	Synced     bool
+}
+
+// Client is a typed client of the chat server. Every request carries its own
+// sequence number and waits for the response echoing it, so requests may be
+// issued concurrently.
+//
+// When the connection is lost the client reconnects and resumes the session
+// on its own, see ConnEvents. Requests waiting for a response fail with
+// ErrDisconnected then, while chat messages not yet accepted by the server
+// are sent again once the session is resumed.
+type Client struct {
+	conn         *conn.Conn
+	seq          int64
+	chats        chan ChatMessage
+	statuses     chan Status
+	presences    chan message.Presence
+	friendEvents chan message.FriendEvent
+	connEvents   chan ConnEvent
+	done         chan struct{}
+	// clientID prefixes the client ids of the chat messages
+	clientID string
+
+	mu      sync.Mutex
+	pending map[int]chan message.Message
+	// unacked holds the packed chat messages waiting for the ack of the
+	// server by sequence number, maxUnacked at most
+	unacked  map[int][]byte
+	watching map[string]struct{}
+	lost     chan struct{}
+	// ready is false from the loss of the connection until the session is
+	// resumed on a new one
+	ready  bool
+	userid string
+	token  string
+	device device
+}
+
+func New() *Client {
+	return &Client{
+		conn:         conn.NewConn(),
+		chats:        make(chan ChatMessage, chatBufSize),
+		statuses:     make(chan Status, chatBufSize),
+		presences:    make(chan message.Presence, chatBufSize),
+		friendEvents: make(chan message.FriendEvent, chatBufSize),
+		connEvents:   make(chan ConnEvent, chatBufSize),
+		done:         make(chan struct{}),
+		clientID:     newClientID(),
+		pending:      make(map[int]chan message.Message),
+		unacked:      make(map[int][]byte),
+		watching:     make(map[string]struct{}),
+		lost:         make(chan struct{}),
+		device:       defaultDevice(),
+	}
+}
+
+func newClientID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func (c *Client) Start() error {
+	err := c.conn.Start()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.ready = true
+	c.mu.Unlock()
+	go c.dispatch()
+	go c.watch()
+	return nil
+}
+
+func (c *Client) Close() {
+	c.conn.Stop()
+}
+
+// Done is closed once the client is closed. A lost connection does not close
+// it, the client reconnects on its own, see ConnEvents.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Chats delivers incoming chat messages. Messages are dropped when the
+// channel is full, so it should be drained continuously.
+func (c *Client) Chats() <-chan ChatMessage {
+	return c.chats
+}
+
+func (c *Client) UserID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.userid
+}
+
+func (c *Client) Register(ctx context.Context, name, passwd string) (userid string, err error) {
+	body, err := c.call(ctx, message.ServerMetadata{
+		Operate:  message.OperateTypeRegister,
+		Username: name,
+		Passwd:   passwd,
+	})
+	return string(body), err
+}
+
+func (c *Client) Login(ctx context.Context, userid, passwd string) error {
+	c.mu.Lock()
+	dev := c.device
+	c.mu.Unlock()
+	body, err := c.call(ctx, message.ServerMetadata{
+		Operate:    message.OperateTypeLogin,
+		Username:   userid,
+		Userid:     userid,
+		Passwd:     passwd,
+		DeviceID:   dev.id,
+		DeviceName: dev.name,
+	})
+	if err != nil {
+		return err
+	}
+	res, err := message.UnpackLoginResult(c.conn.Codec(), body)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.userid = userid
+	c.token = res.Token
+	c.device.id = res.DeviceID
+	c.watching = make(map[string]struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) Logout(ctx context.Context) error {
+	return c.leave(ctx, message.OperateTypeLogout)
+}
+
+// Delete removes the account of the logged in user.
+func (c *Client) Delete(ctx context.Context) error {
+	return c.leave(ctx, message.OperateTypeDelete)
+}
+
+func (c *Client) leave(ctx context.Context, op message.OperateType) error {
+	uid := c.UserID()
+	if uid == "" {
+		return ErrNotLoggedIn
+	}
+	_, err := c.call(ctx, message.ServerMetadata{
+		Operate:  op,
+		Username: uid,
+		Userid:   uid,
+	})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.userid = ""
+	c.token = ""
+	c.watching = make(map[string]struct{})
+	// the messages of the session are not replayed into another one
+	c.unacked = make(map[int][]byte)
+	c.mu.Unlock()
+	return nil
+}
+
+// SearchFriend looks keyword up as a user id first and then as part of a
+// user name.
+func (c *Client) SearchFriend(ctx context.Context, keyword string) (message.UserList, error) {
+	return c.callUsers(ctx, message.ServerMetadata{
+		Operate:  message.OperateTypeSearchFriend,
+		Username: keyword,
+		Userid:   keyword,
+	})
+}
+
+// MakeFriend asks friendID to be friends; they become friends once friendID
+// accepts, or right away if friendID asked first. It returns the friends.
+func (c *Client) MakeFriend(ctx context.Context, friendID string) (message.UserList, error) {
+	return c.friendCall(ctx, message.OperateTypeMakeFriend, friendID)
+}
+
+func (c *Client) DeleteFriend(ctx context.Context, friendID string) (message.UserList, error) {
+	return c.friendCall(ctx, message.OperateTypeDeleteFriend, friendID)
+}
+
+func (c *Client) ListFriend(ctx context.Context) (message.UserList, error) {
+	return c.friendCall(ctx, message.OperateTypeListFriend, "")
+}
+
+func (c *Client) friendCall(ctx context.Context, op message.OperateType, friendID string) (message.UserList, error) {
+	uid := c.UserID()
+	if uid == "" {
+		return nil, ErrNotLoggedIn
+	}
+	return c.callUsers(ctx, message.ServerMetadata{
+		Operate:    op,
+		Userid:     uid,
+		DestUserID: friendID,
+	})
+}
+
+// SendChat sends text to destUserID and returns the id the server assigned
+// to the message once it accepted it.
+func (c *Client) SendChat(ctx context.Context, destUserID, text string) (int64, error) {
+	return c.sendChat(ctx, &message.ChatHeader{DestUserID: destUserID}, text)
+}
+
+// SendGroupChat sends text to every other member of the group.
+func (c *Client) SendGroupChat(ctx context.Context, groupID, text string) (int64, error) {
+	return c.sendChat(ctx, &message.ChatHeader{DestGroupID: groupID}, text)
+}
+
+func (c *Client) sendChat(ctx context.Context, head *message.ChatHeader, text string) (int64, error) {
+	uid := c.UserID()
+	if uid == "" {
+		return 0, ErrNotLoggedIn
+	}
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	seq, ch, release := c.expect()
+	defer release()
+
+	head.SrcAddr = c.conn.LocalAddr()
+	head.SrcUserID = uid
+	head.Seq = seq
+	head.ClientMsgID = c.clientID + "-" + strconv.Itoa(seq)
+	codec := c.conn.Codec()
+	buf, err := message.PackChatHeader(codec, head)
+	if err != nil {
+		return 0, err
+	}
+	msg, err := message.Pack(codec, message.MsgTypeChat, buf, []byte(text))
+	if err != nil {
+		return 0, err
+	}
+	// kept until the ack arrives, however long that takes, to be sent again
+	// after a reconnect
+	c.mu.Lock()
+	if len(c.unacked) >= maxUnacked {
+		c.mu.Unlock()
+		return 0, ErrTooManyUnacked
+	}
+	c.unacked[seq] = msg
+	ready := c.ready
+	c.mu.Unlock()
+	if ready {
+		err = c.conn.Send(msg)
+		if err != nil && err != conn.ErrDisconnected {
+			c.mu.Lock()
+			delete(c.unacked, seq)
+			c.mu.Unlock()
+			return 0, err
+		}
+	}
+
+	resp, err := c.wait(ctx, ch, nil)
+	if err != nil {
+		return 0, err
+	}
+	ack, err := message.UnpackAck(codec, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if ack.Status != message.AckAccepted {
+		return 0, CodeError(ack.Code)
+	}
+	return ack.MsgID, nil
+}
+
+func (c *Client) callUsers(ctx context.Context, meta message.ServerMetadata) (message.UserList, error) {
+	body, err := c.call(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	var users message.UserList
+	err = users.Unmarshal(c.conn.Codec(), body)
+	return users, err
+}
+
+// call sends meta along with the session token, if any, and waits for the
+// matching response. Without a deadline on ctx the Timeout of the client
+// config applies.
+func (c *Client) call(ctx context.Context, meta message.ServerMetadata) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	seq, ch, release := c.expect()
+	defer release()
+
+	codec := c.conn.Codec()
+	c.mu.Lock()
+	meta.Token = c.token
+	lost := c.lost
+	ready := c.ready || meta.Operate == message.OperateTypeResume
+	c.mu.Unlock()
+	if !ready {
+		return nil, ErrDisconnected
+	}
+	head, err := message.PackRequestHeader(codec, c.conn.LocalAddr(), seq)
+	if err != nil {
+		return nil, err
+	}
+	body, err := message.PackMetadata(codec, &meta)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := message.Pack(codec, message.MsgTypeReq, head, body)
+	if err != nil {
+		return nil, err
+	}
+	err = c.conn.Send(msg)
+	if err == conn.ErrDisconnected {
+		return nil, ErrDisconnected
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.wait(ctx, ch, lost)
+	if err != nil {
+		return nil, err
+	}
+	respHead, err := message.UnpackResponseHeader(codec, resp.Head)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, CodeError(respHead.Code)
+}
+
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Duration(config.DefaultConfig.Timeout)*time.Second)
+}
+
+// expect takes the next sequence number and registers the channel its answer
+// is delivered to; release must be called once it is no longer awaited.
+func (c *Client) expect() (seq int, ch chan message.Message, release func()) {
+	seq = int(atomic.AddInt64(&c.seq, 1))
+	ch = make(chan message.Message, 1)
+	c.mu.Lock()
+	c.pending[seq] = ch
+	c.mu.Unlock()
+	return seq, ch, func() {
+		c.mu.Lock()
+		delete(c.pending, seq)
+		c.mu.Unlock()
+	}
+}
+
+// wait waits for the answer on ch, or until the connection the request was
+// sent on is lost, if lost is not nil.
+func (c *Client) wait(ctx context.Context, ch <-chan message.Message, lost <-chan struct{}) (message.Message, error) {
+	select {
+	case <-ctx.Done():
+		return message.Message{}, ctx.Err()
+	case <-c.done:
+		return message.Message{}, ErrClosed
+	case <-lost:
+		return message.Message{}, ErrDisconnected
+	case msg := <-ch:
+		return msg, nil
+	}
+}
+
+func (c *Client) dispatch() {
+	defer close(c.done)
+	codec := c.conn.Codec()
+	for data := range c.conn.ReceiveMsg() {
+		msg, err := message.Unpack(codec, data)
+		if err != nil {
+			log.Errorf("unpack message failed, err: %+v", err)
+			continue
+		}
+		switch {
+		case msg.IsRespMsg():
+			c.onResponse(codec, msg)
+		case msg.IsChatMsg():
+			c.onChat(codec, msg)
+		case msg.IsAckMsg(), msg.IsReceiptMsg():
+			c.onAck(codec, msg)
+		case msg.IsPresenceMsg():
+			c.onPresence(codec, msg)
+		case msg.IsFriendMsg():
+			c.onFriend(codec, msg)
+		case msg.IsPingMsg():
+			c.pong(codec)
+		case msg.IsPongMsg():
+		case msg.IsGoAwayMsg():
+			// the connection is closed soon and reconnects on its own
+			log.Infof("server is going away")
+		default:
+			log.Warnf("unexpected message type %d", msg.MsgType)
+		}
+	}
+}
+
+func (c *Client) pong(codec message.Codec) {
+	buf, err := message.PackPong(codec)
+	if err == nil {
+		err = c.conn.Send(buf)
+	}
+	if err != nil {
+		log.Errorf("answer ping failed, err: %+v", err)
+	}
+}
+
+func (c *Client) onResponse(codec message.Codec, msg message.Message) {
+	head, err := message.UnpackResponseHeader(codec, msg.Head)
+	if err != nil {
+		log.Errorf("unpack response header failed, err: %+v", err)
+		return
+	}
+	c.answer(head.Seq, msg)
+}
+
+// answer hands msg to whoever waits for seq.
+func (c *Client) answer(seq int, msg message.Message) {
+	c.mu.Lock()
+	ch, ok := c.pending[seq]
+	c.mu.Unlock()
+	if !ok {
+		log.Warnf("drop answer with unknown seq %d", seq)
+		return
+	}
+	select {
+	case ch <- msg:
+	default:
+	}
+}
+
+// onChat passes the message on to Chats and tells the sender it was
+// delivered.
+func (c *Client) onChat(codec message.Codec, msg message.Message) {
+	head, err := message.UnpackChatHeader(codec, msg.Head)
+	if err != nil {
+		log.Errorf("unpack chat header failed, err: %+v", err)
+		return
+	}
+	synced := head.SrcUserID == c.UserID()
+	select {
+	case c.chats <- ChatMessage{
+		ID:         head.MsgID,
+		SrcUserID:  head.SrcUserID,
+		DestUserID: head.DestUserID,
+		GroupID:    head.DestGroupID,
+		Text:       string(msg.Body),
+		Time:       time.Unix(0, head.Time*int64(time.Millisecond)),
+		Synced:     synced,
+	}:
+	default:
+		log.Warnf("chat buffer is full, drop message from %s", head.SrcUserID)
+		return
+	}
+	// the copy of a message sent on another device is not delivered to a
+	// recipient
+	if head.MsgID != 0 && !synced {
+		err = c.sendAck(message.MsgTypeAck, message.Ack{Status: message.AckDelivered, MsgID: head.MsgID})
+		if err != nil {
+			log.Errorf("ack message %d failed, err: %+v", head.MsgID, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package sdk
+
+import (
+	"context"
+	"github.com/byronzhu-haha/chat/client/conn"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/log"
+	"sort"
+)
+
+// ConnState is the state of the connection to the server and of the session
+// on it.
+type ConnState byte
+
+const (
+	// StateConnected is reported once connected, after a reconnect only
+	// when the session, if any, is resumed.
+	StateConnected ConnState = iota
+	// StateReconnecting is reported when the connection is lost and after
+	// every failed attempt to reconnect.
+	StateReconnecting
+	// StateSessionLost is reported when the client reconnected but could
+	// not resume the session; the user needs to log in again.
+	StateSessionLost
+	// StateClosed is the last state, once the client is closed.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateSessionLost:
+		return "session lost"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// ConnEvent is a change of the ConnState. Attempt counts the failed attempts
+// to reconnect, Err tells why the connection or the session was lost.
+type ConnEvent struct {
+	State   ConnState
+	Attempt int
+	Err     error
+}
+
+// ConnEvents delivers the changes of the connection state. Like Chats it
+// drops them when full.
+func (c *Client) ConnEvents() <-chan ConnEvent {
+	return c.connEvents
+}
+
+// watch follows the connection, resuming the session after every reconnect.
+func (c *Client) watch() {
+	for e := range c.conn.Events() {
+		switch e.State {
+		case conn.Connected:
+			err := c.resume()
+			if err == ErrDisconnected {
+				// lost again, the next reconnect tries once more
+				continue
+			}
+			if err != nil {
+				c.emit(ConnEvent{State: StateSessionLost, Err: err})
+				continue
+			}
+			c.emit(ConnEvent{State: StateConnected})
+		case conn.Disconnected:
+			if e.Attempt == 0 {
+				c.markLost()
+			}
+			c.emit(ConnEvent{State: StateReconnecting, Attempt: e.Attempt, Err: e.Err})
+		case conn.Closed:
+			c.emit(ConnEvent{State: StateClosed})
+		}
+	}
+}
+
+// markLost fails the requests waiting on the lost connection.
+func (c *Client) markLost() {
+	c.mu.Lock()
+	close(c.lost)
+	c.lost = make(chan struct{})
+	c.ready = false
+	c.mu.Unlock()
+}
+
+// resume logs in again with the token of the session, if there is one, and
+// then sends the chat messages the server did not ack again and subscribes
+// to the presences watched before. The server recognizes the messages it
+// got before the connection was lost and acks them without delivering them
+// twice.
+func (c *Client) resume() error {
+	c.mu.Lock()
+	userid, token, dev := c.userid, c.token, c.device
+	c.mu.Unlock()
+	if token == "" {
+		c.replay()
+		return nil
+	}
+	ctx := context.Background()
+	body, err := c.call(ctx, message.ServerMetadata{
+		Operate:    message.OperateTypeResume,
+		Userid:     userid,
+		Token:      token,
+		DeviceID:   dev.id,
+		DeviceName: dev.name,
+	})
+	if err == ErrDisconnected {
+		return err
+	}
+	var res message.LoginResult
+	if err == nil {
+		res, err = message.UnpackLoginResult(c.conn.Codec(), body)
+	}
+	if err != nil {
+		// the connection is fine, only the user has to log in again
+		c.mu.Lock()
+		c.userid = ""
+		c.token = ""
+		c.ready = true
+		c.mu.Unlock()
+		return err
+	}
+	c.mu.Lock()
+	c.token = res.Token
+	watching := make([]string, 0, len(c.watching))
+	for id := range c.watching {
+		watching = append(watching, id)
+	}
+	c.mu.Unlock()
+
+	c.replay()
+	for _, id := range watching {
+		_, err = c.call(ctx, message.ServerMetadata{
+			Operate:    message.OperateTypeSubscribePresence,
+			DestUserID: id,
+		})
+		if err != nil {
+			log.Warnf("subscribe presence of %s again failed, err: %+v", id, err)
+		}
+	}
+	return nil
+}
+
+// replay sends the unacked chat messages again in the order they were sent
+// and lets new ones through, which wait for mu meanwhile so that they come
+// after.
+func (c *Client) replay() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ready = true
+	seqs := make([]int, 0, len(c.unacked))
+	for seq := range c.unacked {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	for _, seq := range seqs {
+		err := c.conn.Send(c.unacked[seq])
+		if err != nil {
+			log.Warnf("send chat message again failed, err: %+v", err)
+			return
+		}
+	}
+}
+
+func (c *Client) emit(e ConnEvent) {
+	select {
+	case c.connEvents <- e:
+	default:
+		log.Warnf("connection event buffer is full, drop %s event", e.State)
+	}
+}
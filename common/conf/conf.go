@@ -0,0 +1,224 @@
+package conf
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Load fills the struct pointed by v from, in increasing precedence, the
+// `default` tags of its fields, the yaml file at path, the environment
+// variables named prefix_FIELD_NAME and the flags of fs that were set on the
+// command line. fs may be nil; otherwise it must have been prepared with
+// RegisterFlags and already parsed. A missing yaml file is not an error.
+func Load(v interface{}, path, prefix string, fs *flag.FlagSet) error {
+	if err := LoadDefault(v); err != nil {
+		return err
+	}
+	if path != "" {
+		if err := LoadYAML(path, v); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := LoadEnv(prefix, v); err != nil {
+		return err
+	}
+	if fs != nil {
+		return LoadFlags(fs, v)
+	}
+	return nil
+}
+
+func LoadDefault(v interface{}) error {
+	return each(v, func(field reflect.StructField, fv reflect.Value) error {
+		dv, ok := field.Tag.Lookup("default")
+		if !ok {
+			return nil
+		}
+		return set(fv, field, dv)
+	})
+}
+
+func LoadYAML(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(buf, v)
+}
+
+func LoadEnv(prefix string, v interface{}) error {
+	return each(v, func(field reflect.StructField, fv reflect.Value) error {
+		ev, ok := os.LookupEnv(EnvName(prefix, field.Name))
+		if !ok {
+			return nil
+		}
+		return set(fv, field, ev)
+	})
+}
+
+// RegisterFlags defines one string flag per field of v, named after the field
+// in kebab case (ListenAddr becomes -listen-addr). The flag help comes from
+// the `usage` tag.
+func RegisterFlags(fs *flag.FlagSet, v interface{}) {
+	_ = each(v, func(field reflect.StructField, fv reflect.Value) error {
+		fs.String(FlagName(field.Name), field.Tag.Get("default"), field.Tag.Get("usage"))
+		return nil
+	})
+}
+
+func LoadFlags(fs *flag.FlagSet, v interface{}) error {
+	values := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return each(v, func(field reflect.StructField, fv reflect.Value) error {
+		val, ok := values[FlagName(field.Name)]
+		if !ok {
+			return nil
+		}
+		return set(fv, field, val)
+	})
+}
+
+func EnvName(prefix, field string) string {
+	name := strings.ToUpper(strings.Join(splitWords(field), "_"))
+	if prefix == "" {
+		return name
+	}
+	return prefix + "_" + name
+}
+
+func FlagName(field string) string {
+	return strings.ToLower(strings.Join(splitWords(field), "-"))
+}
+
+// splitWords splits a Go identifier into words, keeping acronyms together:
+// TLSCertFile gives TLS, Cert, File.
+func splitWords(s string) []string {
+	var (
+		words []string
+		rs    = []rune(s)
+		start int
+	)
+	for i := 1; i < len(rs); i++ {
+		if !unicode.IsUpper(rs[i]) {
+			continue
+		}
+		if !unicode.IsUpper(rs[i-1]) || (i+1 < len(rs) && unicode.IsLower(rs[i+1])) {
+			words = append(words, string(rs[start:i]))
+			start = i
+		}
+	}
+	return append(words, string(rs[start:]))
+}
+
+func each(v interface{}, fn func(field reflect.StructField, fv reflect.Value) error) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("config must be a pointer to struct")
+	}
+	rv = rv.Elem()
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		if err := fn(t.Field(i), rv.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func set(fv reflect.Value, field reflect.StructField, v string) error {
+	nv, err := coerce(v, field.Type)
+	if err != nil {
+		return fmt.Errorf("coerce field %s failed, err: %w", field.Name, err)
+	}
+	fv.Set(nv)
+	return nil
+}
+
+func coerce(v interface{}, typ reflect.Type) (reflect.Value, error) {
+	var err error
+	switch typ.Kind() {
+	case reflect.String:
+		v, err = coerceString(v)
+	case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err = coerceInt64(v)
+	case reflect.Bool:
+		v, err = coerceBool(v)
+	default:
+		return reflect.Value{}, fmt.Errorf("invalid type %s", typ.String())
+	}
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return valueTypeCoerce(v, typ), nil
+}
+
+func valueTypeCoerce(v interface{}, typ reflect.Type) reflect.Value {
+	val := reflect.ValueOf(v)
+	if reflect.TypeOf(v) == typ {
+		return val
+	}
+	tval := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int16, reflect.Int32, reflect.Int64:
+		tval.SetInt(val.Int())
+	case reflect.String:
+		tval.SetString(val.String())
+	case reflect.Bool:
+		tval.SetBool(val.Bool())
+	default:
+		tval.Set(val)
+	}
+	return tval
+}
+
+func coerceString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int, int16, int32, int64, uint, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", v), nil
+	case float32, float64:
+		return fmt.Sprintf("%f", v), nil
+	}
+	return fmt.Sprintf("%s", v), nil
+}
+
+func coerceInt64(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case int, int16, int32, int64:
+		return reflect.ValueOf(v).Int(), nil
+	case uint, uint16, uint32, uint64:
+		return int64(reflect.ValueOf(v).Uint()), nil
+	}
+	return 0, errors.New("invalid value type")
+}
+
+func coerceBool(v interface{}) (bool, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(v)
+	}
+	return false, errors.New("invalid value type")
+}
@@ -0,0 +1,145 @@
+package group
+
+import (
+	"sort"
+)
+
+type Kind byte
+
+const (
+	// Private groups are joined by invitation only.
+	Private Kind = iota
+	// Room is open, anyone may join.
+	Room
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Private:
+		return "group"
+	case Room:
+		return "room"
+	}
+	return "unknown"
+}
+
+type Group struct {
+	id      string
+	name    string
+	kind    Kind
+	owner   string
+	members map[string]struct{}
+}
+
+type BriefGroup struct {
+	ID      string
+	Name    string
+	Kind    Kind
+	Owner   string
+	Members int
+}
+
+func NewGroup(id, name string, kind Kind, owner string) *Group {
+	return &Group{
+		id:      id,
+		name:    name,
+		kind:    kind,
+		owner:   owner,
+		members: map[string]struct{}{owner: {}},
+	}
+}
+
+func (g *Group) ID() string {
+	return g.id
+}
+
+func (g *Group) Name() string {
+	return g.name
+}
+
+func (g *Group) Kind() Kind {
+	return g.kind
+}
+
+func (g *Group) Owner() string {
+	return g.owner
+}
+
+func (g *Group) Brief() BriefGroup {
+	return BriefGroup{
+		ID:      g.id,
+		Name:    g.name,
+		Kind:    g.kind,
+		Owner:   g.owner,
+		Members: len(g.members),
+	}
+}
+
+func (g *Group) IsMember(userid string) bool {
+	_, ok := g.members[userid]
+	return ok
+}
+
+func (g *Group) AddMember(userid string) {
+	g.members[userid] = struct{}{}
+}
+
+// DelMember removes userid from the group. When the owner leaves, the member
+// with the smallest id becomes the owner.
+func (g *Group) DelMember(userid string) {
+	delete(g.members, userid)
+	if userid != g.owner {
+		return
+	}
+	g.owner = ""
+	if ms := g.Members(); len(ms) > 0 {
+		g.owner = ms[0]
+	}
+}
+
+func (g *Group) Empty() bool {
+	return len(g.members) == 0
+}
+
+// Members returns the ids of the members, sorted.
+func (g *Group) Members() []string {
+	res := make([]string, 0, len(g.members))
+	for id := range g.members {
+		res = append(res, id)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Record is the persistent form of a Group.
+type Record struct {
+	ID      string
+	Name    string
+	Kind    Kind
+	Owner   string
+	Members []string
+}
+
+func (g *Group) Record() Record {
+	return Record{
+		ID:      g.id,
+		Name:    g.name,
+		Kind:    g.kind,
+		Owner:   g.owner,
+		Members: g.Members(),
+	}
+}
+
+func FromRecord(r Record) *Group {
+	g := &Group{
+		id:      r.ID,
+		name:    r.Name,
+		kind:    r.Kind,
+		owner:   r.Owner,
+		members: make(map[string]struct{}, len(r.Members)),
+	}
+	for _, id := range r.Members {
+		g.members[id] = struct{}{}
+	}
+	return g
+}
@@ -0,0 +1,94 @@
+package message
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	GobCodec   Codec = gobCodec{}
+	JSONCodec  Codec = jsonCodec{}
+	ProtoCodec Codec = protoCodec{}
+
+	// HandshakeCodec encodes the handshake frames, which are exchanged before
+	// a codec is negotiated and must be readable by every client.
+	HandshakeCodec = JSONCodec
+)
+
+var codecs = map[string]Codec{
+	GobCodec.Name():   GobCodec,
+	JSONCodec.Name():  JSONCodec,
+	ProtoCodec.Name(): ProtoCodec,
+}
+
+func CodecByName(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+// CodecCapability is the capability a client advertises to ask for codec c.
+// Gob is the fallback every peer speaks, so it has no bit of its own.
+func CodecCapability(c Codec) Capability {
+	switch c.Name() {
+	case JSONCodec.Name():
+		return CapCodecJSON
+	case ProtoCodec.Name():
+		return CapCodecProto
+	}
+	return 0
+}
+
+// Codec picks the codec selected by a negotiated capability set.
+func (c Capability) Codec() Codec {
+	switch {
+	case c.Has(CapCodecProto):
+		return ProtoCodec
+	case c.Has(CapCodecJSON):
+		return JSONCodec
+	}
+	return GobCodec
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf = &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,340 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// protoCodec speaks the protobuf wire format without generated code. The
+// field number of a struct field is its index in the struct plus one, so
+// fields of a wire struct may only ever be appended. Signed integers are
+// zigzag encoded (sint32/sint64), slices other than []byte are written as
+// unpacked repeated fields and read packed or not, structs and pointers to structs are embedded messages and
+// zero values are omitted. A top-level value that is not a struct, such as
+// UserList, is encoded as field 1 of an implicit wrapper message.
+type protoCodec struct{}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("proto: truncated data")
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return []byte{}, nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Struct {
+		return appendProtoStruct([]byte{}, rv)
+	}
+	return appendProtoField([]byte{}, 1, rv, false)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("proto: unmarshal target must be a non-nil pointer")
+	}
+	rv = rv.Elem()
+	if rv.Kind() == reflect.Struct {
+		return consumeProtoStruct(data, rv)
+	}
+	return consumeProtoFields(data, func(num int, wt int, u uint64, b []byte) error {
+		if num != 1 {
+			return nil
+		}
+		return setProtoValue(rv, wt, u, b)
+	})
+}
+
+func appendProtoTag(buf []byte, num int, wt int) []byte {
+	return binary.AppendUvarint(buf, uint64(num)<<3|uint64(wt))
+}
+
+func appendProtoStruct(buf []byte, rv reflect.Value) ([]byte, error) {
+	t := rv.Type()
+	var err error
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		buf, err = appendProtoField(buf, i+1, rv.Field(i), false)
+		if err != nil {
+			return nil, fmt.Errorf("proto: field %s.%s: %w", t.Name(), t.Field(i).Name, err)
+		}
+	}
+	return buf, nil
+}
+
+// appendProtoField encodes fv as field num. Zero values are skipped unless
+// force is set, which is needed for elements of repeated fields.
+func appendProtoField(buf []byte, num int, fv reflect.Value, force bool) ([]byte, error) {
+	switch fv.Kind() {
+	case reflect.Bool:
+		if !fv.Bool() && !force {
+			return buf, nil
+		}
+		var u uint64
+		if fv.Bool() {
+			u = 1
+		}
+		buf = appendProtoTag(buf, num, wireVarint)
+		return binary.AppendUvarint(buf, u), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := fv.Int()
+		if n == 0 && !force {
+			return buf, nil
+		}
+		buf = appendProtoTag(buf, num, wireVarint)
+		return binary.AppendUvarint(buf, uint64(n<<1)^uint64(n>>63)), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := fv.Uint()
+		if u == 0 && !force {
+			return buf, nil
+		}
+		buf = appendProtoTag(buf, num, wireVarint)
+		return binary.AppendUvarint(buf, u), nil
+	case reflect.Float32:
+		f := fv.Float()
+		if f == 0 && !force {
+			return buf, nil
+		}
+		buf = appendProtoTag(buf, num, wireFixed32)
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(f))), nil
+	case reflect.Float64:
+		f := fv.Float()
+		if f == 0 && !force {
+			return buf, nil
+		}
+		buf = appendProtoTag(buf, num, wireFixed64)
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(f)), nil
+	case reflect.String:
+		if fv.Len() == 0 && !force {
+			return buf, nil
+		}
+		buf = appendProtoTag(buf, num, wireBytes)
+		buf = binary.AppendUvarint(buf, uint64(fv.Len()))
+		return append(buf, fv.String()...), nil
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() == reflect.Uint8 {
+			if fv.Len() == 0 && !force {
+				return buf, nil
+			}
+			buf = appendProtoTag(buf, num, wireBytes)
+			buf = binary.AppendUvarint(buf, uint64(fv.Len()))
+			return append(buf, fv.Bytes()...), nil
+		}
+		var err error
+		for i := 0; i < fv.Len(); i++ {
+			buf, err = appendProtoField(buf, num, fv.Index(i), true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Struct:
+		nested, err := appendProtoStruct(nil, fv)
+		if err != nil {
+			return nil, err
+		}
+		if len(nested) == 0 && !force {
+			return buf, nil
+		}
+		buf = appendProtoTag(buf, num, wireBytes)
+		buf = binary.AppendUvarint(buf, uint64(len(nested)))
+		return append(buf, nested...), nil
+	case reflect.Ptr:
+		if fv.IsNil() {
+			return buf, nil
+		}
+		return appendProtoField(buf, num, fv.Elem(), true)
+	}
+	return nil, fmt.Errorf("unsupported kind %s", fv.Kind())
+}
+
+// consumeProtoFields walks the fields of an encoded message. For varint and
+// fixed fields u holds the value, for length-delimited fields b holds the
+// payload.
+func consumeProtoFields(data []byte, fn func(num int, wt int, u uint64, b []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		data = data[n:]
+		var (
+			num = int(tag >> 3)
+			wt  = int(tag & 7)
+			u   uint64
+			b   []byte
+		)
+		switch wt {
+		case wireVarint:
+			u, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errProtoTruncated
+			}
+			u = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errProtoTruncated
+			}
+			u = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errProtoTruncated
+			}
+			b = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			return fmt.Errorf("proto: unsupported wire type %d", wt)
+		}
+		if err := fn(num, wt, u, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func consumeProtoStruct(data []byte, rv reflect.Value) error {
+	t := rv.Type()
+	return consumeProtoFields(data, func(num int, wt int, u uint64, b []byte) error {
+		// unknown fields are skipped so that older peers can read newer messages
+		if num < 1 || num > t.NumField() || t.Field(num-1).PkgPath != "" {
+			return nil
+		}
+		err := setProtoValue(rv.Field(num-1), wt, u, b)
+		if err != nil {
+			return fmt.Errorf("proto: field %s.%s: %w", t.Name(), t.Field(num-1).Name, err)
+		}
+		return nil
+	})
+}
+
+func setProtoValue(fv reflect.Value, wt int, u uint64, b []byte) error {
+	want := wireVarint
+	switch fv.Kind() {
+	case reflect.Float32:
+		want = wireFixed32
+	case reflect.Float64:
+		want = wireFixed64
+	case reflect.String, reflect.Struct:
+		want = wireBytes
+	case reflect.Slice:
+		if fv.Type().Elem().Kind() == reflect.Uint8 {
+			want = wireBytes
+		} else {
+			if elemWt, ok := packedWireType(fv.Type().Elem().Kind()); ok && wt == wireBytes {
+				return appendPacked(fv, elemWt, b)
+			}
+			elem := reflect.New(fv.Type().Elem()).Elem()
+			if err := setProtoValue(elem, wt, u, b); err != nil {
+				return err
+			}
+			fv.Set(reflect.Append(fv, elem))
+			return nil
+		}
+	case reflect.Ptr:
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		return setProtoValue(fv.Elem(), wt, u, b)
+	}
+	if wt != want {
+		return fmt.Errorf("wire type %d does not match kind %s", wt, fv.Kind())
+	}
+
+	switch fv.Kind() {
+	case reflect.Bool:
+		fv.SetBool(u != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fv.SetInt(int64(u>>1) ^ -int64(u&1))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		fv.SetUint(u)
+	case reflect.Float32:
+		fv.SetFloat(float64(math.Float32frombits(uint32(u))))
+	case reflect.Float64:
+		fv.SetFloat(math.Float64frombits(u))
+	case reflect.String:
+		fv.SetString(string(b))
+	case reflect.Slice:
+		fv.SetBytes(append([]byte{}, b...))
+	case reflect.Struct:
+		return consumeProtoStruct(b, fv)
+	default:
+		return fmt.Errorf("unsupported kind %s", fv.Kind())
+	}
+	return nil
+}
+
+// packedWireType returns the wire type of the elements of a repeated field of
+// kind k, if such a field may be packed.
+func packedWireType(k reflect.Kind) (int, bool) {
+	switch k {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return wireVarint, true
+	case reflect.Float32:
+		return wireFixed32, true
+	case reflect.Float64:
+		return wireFixed64, true
+	}
+	return 0, false
+}
+
+// appendPacked appends the elements of the packed repeated field b, of wire
+// type wt each, to the slice fv.
+func appendPacked(fv reflect.Value, wt int, b []byte) error {
+	for len(b) > 0 {
+		var u uint64
+		switch wt {
+		case wireVarint:
+			var n int
+			u, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			u = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			u = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		}
+		elem := reflect.New(fv.Type().Elem()).Elem()
+		if err := setProtoValue(elem, wt, u, nil); err != nil {
+			return err
+		}
+		fv.Set(reflect.Append(fv, elem))
+	}
+	return nil
+}
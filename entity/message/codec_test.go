@@ -0,0 +1,148 @@
+package message
+
+import (
+	"github.com/byronzhu-haha/chat/entity/group"
+	"github.com/byronzhu-haha/chat/entity/user"
+	"reflect"
+	"testing"
+)
+
+var allCodecs = []Codec{GobCodec, JSONCodec, ProtoCodec}
+
+func TestCodecRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		in   interface{}
+		out  func() interface{}
+	}{
+		{"metadata", &ServerMetadata{
+			Operate:    OperateTypeSetPrivacy,
+			Userid:     "10001",
+			Passwd:     "p@ss wörd",
+			Token:      "a.b",
+			GroupID:    "g1",
+			GroupKind:  group.Room,
+			BeforeID:   -1,
+			AfterID:    1 << 40,
+			Limit:      50,
+			State:      user.Busy,
+			StatusText: "in a meeting",
+			Privacy:    user.Privacy{Search: user.Friends, FriendRequest: user.Nobody},
+			DeviceID:   "d1",
+		}, func() interface{} { return &ServerMetadata{} }},
+		{"chat header", &ChatHeader{
+			SrcUserID:   "1",
+			DestGroupID: "2",
+			Seq:         7,
+			MsgID:       42,
+			Time:        1700000000000,
+			ClientMsgID: "c-7",
+		}, func() interface{} { return &ChatHeader{} }},
+		{"ack", &Ack{Status: AckRejected, Seq: 3, MsgID: 9, Code: CodeForbidden, UserID: "u"},
+			func() interface{} { return &Ack{} }},
+		{"user list", &UserList{{ID: "1", Name: "a", State: user.Online}, {ID: "2", LastSeen: 5}},
+			func() interface{} { return &UserList{} }},
+		{"history page", &HistoryPage{
+			Messages: []ChatRecord{{ID: 1, SrcUserID: "a", Body: []byte("hi")}, {ID: 2, Body: []byte{0, 255}}},
+			More:     true,
+		}, func() interface{} { return &HistoryPage{} }},
+		{"sessions", &SessionList{{DeviceID: "d", DeviceName: "phone", Since: 1, Current: true}},
+			func() interface{} { return &SessionList{} }},
+	}
+	for _, c := range allCodecs {
+		for _, tc := range cases {
+			t.Run(c.Name()+"/"+tc.name, func(t *testing.T) {
+				buf, err := c.Marshal(tc.in)
+				if err != nil {
+					t.Fatalf("marshal: %v", err)
+				}
+				out := tc.out()
+				if err = c.Unmarshal(buf, out); err != nil {
+					t.Fatalf("unmarshal: %v", err)
+				}
+				if !reflect.DeepEqual(tc.in, out) {
+					t.Fatalf("got %+v, want %+v", out, tc.in)
+				}
+			})
+		}
+	}
+}
+
+func TestPackUnpack(t *testing.T) {
+	for _, c := range allCodecs {
+		t.Run(c.Name(), func(t *testing.T) {
+			data, err := Pack(c, MsgTypeChat, []byte("head"), []byte("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := Unpack(c, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !msg.IsChatMsg() || string(msg.Head) != "head" || string(msg.Body) != "body" {
+				t.Fatalf("got %+v", msg)
+			}
+		})
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	for _, c := range allCodecs {
+		got, err := CodecByName(c.Name())
+		if err != nil || got != c {
+			t.Fatalf("CodecByName(%q) = %v, %v", c.Name(), got, err)
+		}
+		if CodecCapability(c).Codec() != c {
+			t.Fatalf("capability of %s picks %s", c.Name(), CodecCapability(c).Codec().Name())
+		}
+	}
+	if _, err := CodecByName("xml"); err == nil {
+		t.Fatal("unknown codec accepted")
+	}
+}
+
+// packedFixture has a repeated field of every packable kind.
+type packedFixture struct {
+	Ints   []int64
+	Uints  []uint32
+	Flags  []bool
+	Ratios []float64
+	Temps  []float32
+}
+
+func TestProtoPacked(t *testing.T) {
+	// as written by protoc for packed sint64, uint32, bool, double and float
+	// fields, with one more Ints element unpacked at the end
+	data := []byte{
+		0x0a, 0x04, 0x02, 0x03, 0xd8, 0x04,
+		0x12, 0x03, 0x07, 0x80, 0x01,
+		0x1a, 0x03, 0x01, 0x00, 0x01,
+		0x22, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf8, 0x3f,
+		0x2a, 0x04, 0x00, 0x00, 0x80, 0xbf,
+		0x08, 0x0a,
+	}
+	var got packedFixture
+	if err := ProtoCodec.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := packedFixture{
+		Ints:   []int64{1, -2, 300, 5},
+		Uints:  []uint32{7, 128},
+		Flags:  []bool{true, false, true},
+		Ratios: []float64{1.5},
+		Temps:  []float32{-1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	for _, bad := range [][]byte{
+		{0x0a, 0x01, 0xd8},
+		{0x22, 0x04, 0x00, 0x00, 0xf8, 0x3f},
+		{0x2a, 0x02, 0x80, 0xbf},
+	} {
+		if err := ProtoCodec.Unmarshal(bad, &packedFixture{}); err == nil {
+			t.Errorf("truncated packed field % x accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	frameHeaderSize = 4
+
+	DefaultMaxFrameSize = 4 << 20
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame exceeds max frame size")
+)
+
+// Framer splits a byte stream into frames, each prefixed by its length as a
+// big-endian uint32. ReadFrame keeps partial progress between calls, so a read
+// deadline that fires in the middle of a frame does not corrupt the stream.
+type Framer struct {
+	r       *bufio.Reader
+	w       io.Writer
+	maxSize int
+	wmu     sync.Mutex
+
+	compress bool
+
+	head  [frameHeaderSize]byte
+	headN int
+	body  []byte
+	bodyN int
+}
+
+func NewFramer(rw io.ReadWriter, maxFrameSize int) *Framer {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &Framer{
+		r:       bufio.NewReader(rw),
+		w:       rw,
+		maxSize: maxFrameSize,
+	}
+}
+
+func (f *Framer) ReadFrame() ([]byte, error) {
+	for f.headN < frameHeaderSize {
+		n, err := f.r.Read(f.head[f.headN:])
+		f.headN += n
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.body == nil {
+		size := binary.BigEndian.Uint32(f.head[:])
+		if uint64(size) > uint64(f.maxSize) {
+			f.reset()
+			return nil, ErrFrameTooLarge
+		}
+		f.body = make([]byte, size)
+	}
+	for f.bodyN < len(f.body) {
+		n, err := f.r.Read(f.body[f.bodyN:])
+		f.bodyN += n
+		if err != nil {
+			return nil, err
+		}
+	}
+	frame := f.body
+	f.reset()
+	if f.compress {
+		return f.inflate(frame)
+	}
+	return frame, nil
+}
+
+func (f *Framer) WriteFrame(data []byte) error {
+	if len(data) > f.maxSize {
+		return ErrFrameTooLarge
+	}
+	if f.compress {
+		var err error
+		data, err = deflate(data)
+		if err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, frameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[frameHeaderSize:], data)
+
+	f.wmu.Lock()
+	_, err := f.w.Write(buf)
+	f.wmu.Unlock()
+	return err
+}
+
+func (f *Framer) reset() {
+	f.headN = 0
+	f.body = nil
+	f.bodyN = 0
+}
+
+// EnableCompression switches both directions to deflate-compressed frames. It
+// must be called by each side right after the handshake has agreed on
+// CapCompression, before any other frame is exchanged.
+func (f *Framer) EnableCompression() {
+	f.compress = true
+}
+
+func (f *Framer) inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	res, err := io.ReadAll(io.LimitReader(r, int64(f.maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > f.maxSize {
+		return nil, ErrFrameTooLarge
+	}
+	return res, nil
+}
+
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
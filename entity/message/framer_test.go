@@ -0,0 +1,111 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFramerRoundTrip(t *testing.T) {
+	frames := [][]byte{
+		[]byte("hello"),
+		{},
+		bytes.Repeat([]byte("abc"), 10000),
+		{0, 1, 2, 255},
+	}
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		w := NewFramer(&buf, 0)
+		r := NewFramer(&buf, 0)
+		if compress {
+			w.EnableCompression()
+			r.EnableCompression()
+		}
+		for _, f := range frames {
+			if err := w.WriteFrame(f); err != nil {
+				t.Fatalf("compress %v: write: %v", compress, err)
+			}
+		}
+		for i, want := range frames {
+			got, err := r.ReadFrame()
+			if err != nil {
+				t.Fatalf("compress %v: read %d: %v", compress, i, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("compress %v: frame %d differs", compress, i)
+			}
+		}
+		if _, err := r.ReadFrame(); err != io.EOF {
+			t.Fatalf("compress %v: got %v after the last frame, want EOF", compress, err)
+		}
+	}
+}
+
+func TestFramerCompresses(t *testing.T) {
+	var plain, compressed bytes.Buffer
+	data := bytes.Repeat([]byte("chat "), 1000)
+	_ = NewFramer(&plain, 0).WriteFrame(data)
+	f := NewFramer(&compressed, 0)
+	f.EnableCompression()
+	_ = f.WriteFrame(data)
+	if compressed.Len() >= plain.Len() {
+		t.Fatalf("compressed frame is %d bytes, plain %d", compressed.Len(), plain.Len())
+	}
+}
+
+func TestFramerTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewFramer(&buf, 8).WriteFrame(make([]byte, 9)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("write: got %v", err)
+	}
+	_ = NewFramer(&buf, 0).WriteFrame(make([]byte, 9))
+	if _, err := NewFramer(&buf, 8).ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("read: got %v", err)
+	}
+
+	// a small compressed frame must not inflate beyond the limit either
+	buf.Reset()
+	w := NewFramer(&buf, 1<<20)
+	w.EnableCompression()
+	_ = w.WriteFrame(make([]byte, 1<<20))
+	r := NewFramer(&buf, 1024)
+	r.EnableCompression()
+	if _, err := r.ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("inflate: got %v", err)
+	}
+}
+
+// A read deadline firing in the middle of a frame leaves the framer where it
+// was, the next ReadFrame completes the frame.
+func TestFramerResumesAfterTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	var frame bytes.Buffer
+	_ = NewFramer(&frame, 0).WriteFrame([]byte("split frame"))
+	data := frame.Bytes()
+
+	r := NewFramer(server, 0)
+	go func() {
+		_, _ = client.Write(data[:6])
+	}()
+	_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := r.ReadFrame()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	go func() {
+		_, _ = client.Write(data[6:])
+	}()
+	_ = server.SetReadDeadline(time.Time{})
+	got, err := r.ReadFrame()
+	if err != nil || string(got) != "split frame" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,73 @@
+package message
+
+const (
+	ProtocolVersion    uint16 = 1
+	MinProtocolVersion uint16 = 1
+)
+
+type Capability uint32
+
+const (
+	CapCompression Capability = 1 << iota // 帧压缩
+	CapAck                                // 消息回执
+	CapCodecJSON                          // json 编码
+	CapCodecProto                         // protobuf 编码
+)
+
+func (c Capability) Has(o Capability) bool {
+	return c&o == o
+}
+
+type Handshake struct {
+	Version      uint16
+	ClientName   string
+	Capabilities Capability
+}
+
+func PackHandshake(version uint16, clientName string, caps Capability) ([]byte, error) {
+	return HandshakeCodec.Marshal(&Handshake{
+		Version:      version,
+		ClientName:   clientName,
+		Capabilities: caps,
+	})
+}
+
+func UnpackHandshake(data []byte) (hs Handshake, err error) {
+	err = HandshakeCodec.Unmarshal(data, &hs)
+	return hs, err
+}
+
+type HandshakeAck struct {
+	Version      uint16
+	Code         Code
+	Capabilities Capability
+}
+
+func PackHandshakeAck(version uint16, code Code, caps Capability) ([]byte, error) {
+	return HandshakeCodec.Marshal(&HandshakeAck{
+		Version:      version,
+		Code:         code,
+		Capabilities: caps,
+	})
+}
+
+func UnpackHandshakeAck(data []byte) (ack HandshakeAck, err error) {
+	err = HandshakeCodec.Unmarshal(data, &ack)
+	return ack, err
+}
+
+// Negotiate checks the client hello against what the server supports and
+// returns the ack the server should answer with.
+func Negotiate(hs Handshake, supported Capability) HandshakeAck {
+	if hs.Version < MinProtocolVersion || hs.Version > ProtocolVersion {
+		return HandshakeAck{
+			Version: ProtocolVersion,
+			Code:    CodeIncompatibleVersion,
+		}
+	}
+	return HandshakeAck{
+		Version:      hs.Version,
+		Code:         CodeOk,
+		Capabilities: hs.Capabilities & supported,
+	}
+}
@@ -1,32 +1,31 @@
 package message
 
 import (
-	"bytes"
-	"encoding/gob"
+	"fmt"
+	"github.com/byronzhu-haha/chat/entity/group"
 	"github.com/byronzhu-haha/chat/entity/user"
 )
 
 const serverLogo = "server"
 
-func marshal(v interface{}) ([]byte, error) {
-	var buf = &bytes.Buffer{}
-	err := gob.NewEncoder(buf).Encode(v)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
-func unmarshal(data []byte, res interface{}) error {
-	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(res)
-}
-
 type MsgType byte
 
 const (
 	MsgTypeReq MsgType = iota
 	MsgTypeResp
 	MsgTypeChat
+	MsgTypeHandshake
+	MsgTypeAck
+	MsgTypeReceipt
+	MsgTypePresence
+	MsgTypeFriend
+	// MsgTypePing asks the peer to answer with MsgTypePong, to tell that
+	// the connection is alive while there is nothing else to send.
+	MsgTypePing
+	MsgTypePong
+	// MsgTypeGoAway tells the client the server is shutting down; the
+	// requests sent before are still answered, later ones are not read.
+	MsgTypeGoAway
 )
 
 type Message struct {
@@ -35,16 +34,16 @@ type Message struct {
 	Body    []byte
 }
 
-func Pack(msgType MsgType, head, body []byte) ([]byte, error) {
-	return marshal(&Message{
+func Pack(c Codec, msgType MsgType, head, body []byte) ([]byte, error) {
+	return c.Marshal(&Message{
 		MsgType: msgType,
 		Head:    head,
 		Body:    body,
 	})
 }
 
-func Unpack(data []byte) (msg Message, err error) {
-	err = unmarshal(data, &msg)
+func Unpack(c Codec, data []byte) (msg Message, err error) {
+	err = c.Unmarshal(data, &msg)
 	return msg, err
 }
 
@@ -60,20 +59,66 @@ func (m *Message) IsChatMsg() bool {
 	return m.MsgType == MsgTypeChat
 }
 
+func (m *Message) IsHandshakeMsg() bool {
+	return m.MsgType == MsgTypeHandshake
+}
+
+func (m *Message) IsAckMsg() bool {
+	return m.MsgType == MsgTypeAck
+}
+
+func (m *Message) IsReceiptMsg() bool {
+	return m.MsgType == MsgTypeReceipt
+}
+
+func (m *Message) IsPresenceMsg() bool {
+	return m.MsgType == MsgTypePresence
+}
+
+func (m *Message) IsFriendMsg() bool {
+	return m.MsgType == MsgTypeFriend
+}
+
+func (m *Message) IsPingMsg() bool {
+	return m.MsgType == MsgTypePing
+}
+
+func (m *Message) IsPongMsg() bool {
+	return m.MsgType == MsgTypePong
+}
+
+func (m *Message) IsGoAwayMsg() bool {
+	return m.MsgType == MsgTypeGoAway
+}
+
+func PackPing(c Codec) ([]byte, error) {
+	return Pack(c, MsgTypePing, nil, nil)
+}
+
+func PackPong(c Codec) ([]byte, error) {
+	return Pack(c, MsgTypePong, nil, nil)
+}
+
+func PackGoAway(c Codec) ([]byte, error) {
+	return Pack(c, MsgTypeGoAway, nil, nil)
+}
+
 type RequestHeader struct {
 	SrcAddr  string
 	DestAddr string
+	Seq      int
 }
 
-func PackRequestHeader(srcAddr string) ([]byte, error) {
-	return marshal(&RequestHeader{
+func PackRequestHeader(c Codec, srcAddr string, seq int) ([]byte, error) {
+	return c.Marshal(&RequestHeader{
 		SrcAddr:  srcAddr,
 		DestAddr: serverLogo,
+		Seq:      seq,
 	})
 }
 
-func UnpackRequestHeader(data []byte) (head RequestHeader, err error) {
-	err = unmarshal(data, &head)
+func UnpackRequestHeader(c Codec, data []byte) (head RequestHeader, err error) {
+	err = c.Unmarshal(data, &head)
 	return head, err
 }
 
@@ -84,8 +129,30 @@ const (
 	CodeFailed
 	CodeTimeout
 	CodeInvalidOperate
+	CodeIncompatibleVersion
+	CodeWeakPassword
+	CodeUnauthorized
+	CodeForbidden
 )
 
+var codeText = map[Code]string{
+	CodeOk:                  "ok",
+	CodeFailed:              "failed",
+	CodeTimeout:             "timeout",
+	CodeInvalidOperate:      "invalid operate",
+	CodeIncompatibleVersion: "incompatible version",
+	CodeWeakPassword:        "weak password",
+	CodeUnauthorized:        "unauthorized",
+	CodeForbidden:           "forbidden",
+}
+
+func (c Code) String() string {
+	if s, ok := codeText[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("code(%d)", int32(c))
+}
+
 type ResponseHeader struct {
 	Op       OperateType
 	Seq      int
@@ -93,8 +160,8 @@ type ResponseHeader struct {
 	DestAddr string
 }
 
-func PackResponseHeader(destAddr string, op OperateType, seq int, code Code) ([]byte, error) {
-	return marshal(&ResponseHeader{
+func PackResponseHeader(c Codec, destAddr string, op OperateType, seq int, code Code) ([]byte, error) {
+	return c.Marshal(&ResponseHeader{
 		Op:       op,
 		Seq:      seq,
 		Code:     code,
@@ -102,43 +169,158 @@ func PackResponseHeader(destAddr string, op OperateType, seq int, code Code) ([]
 	})
 }
 
-func UnpackResponseHeader(data []byte) (head ResponseHeader, err error) {
-	err = unmarshal(data, &head)
+func UnpackResponseHeader(c Codec, data []byte) (head ResponseHeader, err error) {
+	err = c.Unmarshal(data, &head)
 	return head, err
 }
 
+// ChatHeader addresses a chat message either to a single user by DestUserID
+// or to every member of a group by DestGroupID. The server fills in the
+// recipient as DestUserID when it fans a group message out.
+//
+// Seq is chosen by the sender and echoed in the ack of the server, MsgID
+// and Time are assigned by the server and set on delivery.
 type ChatHeader struct {
-	SrcAddr    string
-	SrcUserID  string
-	DestUserID string
+	SrcAddr     string
+	SrcUserID   string
+	DestUserID  string
+	DestGroupID string
+	Seq         int
+	MsgID       int64
+	Time        int64
+	// ClientMsgID is unique per message of a client, so that the server
+	// can tell a message sent again after a reconnect from a new one.
+	ClientMsgID string
 }
 
-func PackChatHeader(srcAddr, srcUserID, destUserID string) ([]byte, error) {
-	return marshal(&ChatHeader{
-		SrcAddr:    srcAddr,
-		SrcUserID:  srcUserID,
-		DestUserID: destUserID,
-	})
+func PackChatHeader(c Codec, head *ChatHeader) ([]byte, error) {
+	return c.Marshal(head)
 }
 
-func UnpackChatHeader(data []byte) (head ChatHeader, err error) {
-	err = unmarshal(data, &head)
+func UnpackChatHeader(c Codec, data []byte) (head ChatHeader, err error) {
+	err = c.Unmarshal(data, &head)
 	return head, err
 }
 
+type AckStatus byte
+
+const (
+	AckAccepted  AckStatus = iota + 1 // 服务端已接收
+	AckRejected                       // 服务端已拒绝
+	AckDelivered                      // 已送达
+	AckRead                           // 已读
+)
+
+var ackText = map[AckStatus]string{
+	AckAccepted:  "accepted",
+	AckRejected:  "rejected",
+	AckDelivered: "delivered",
+	AckRead:      "read",
+}
+
+func (a AckStatus) String() string {
+	if s, ok := ackText[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("ack(%d)", byte(a))
+}
+
+// Ack reports the status of a chat message. The server answers every chat
+// message with an accepted or rejected ack carrying the Seq of the sender,
+// recipients send a delivered ack once they got it and a read receipt once
+// it was read, both of which the server forwards to the sender with UserID
+// set to the recipient.
+type Ack struct {
+	Status  AckStatus
+	Seq     int
+	MsgID   int64
+	Code    Code
+	UserID  string
+	GroupID string
+}
+
+func PackAck(c Codec, ack *Ack) ([]byte, error) {
+	return c.Marshal(ack)
+}
+
+func UnpackAck(c Codec, data []byte) (ack Ack, err error) {
+	err = c.Unmarshal(data, &ack)
+	return ack, err
+}
+
 type OperateType byte
 
 const (
-	OperateTypeRegister     OperateType = iota + 1 // 注册
-	OperateTypeLogin                               // 登录
-	OperateTypeLogout                              // 登出
-	OperateTypeDelete                              // 注销
-	OperateTypeSearchFriend                        // 搜索好友
-	OperateTypeMakeFriend                          // 交友
-	OperateTypeDeleteFriend                        // 删除好友
-	OperateTypeListFriend                          // 好友列表
+	OperateTypeRegister            OperateType = iota + 1 // 注册
+	OperateTypeLogin                                      // 登录
+	OperateTypeLogout                                     // 登出
+	OperateTypeDelete                                     // 注销
+	OperateTypeSearchFriend                               // 搜索好友
+	OperateTypeMakeFriend                                 // 交友
+	OperateTypeDeleteFriend                               // 删除好友
+	OperateTypeListFriend                                 // 好友列表
+	OperateTypeCreateGroup                                // 创建群组
+	OperateTypeJoinGroup                                  // 加入群组
+	OperateTypeLeaveGroup                                 // 退出群组
+	OperateTypeInviteGroup                                // 邀请入群
+	OperateTypeListGroupMember                            // 群成员列表
+	OperateTypeHistory                                    // 聊天记录
+	OperateTypeSubscribePresence                          // 订阅在线状态
+	OperateTypeUnsubscribePresence                        // 取消订阅在线状态
+	OperateTypeSetPresence                                // 设置在线状态
+	OperateTypeAcceptFriend                               // 同意好友请求
+	OperateTypeRejectFriend                               // 拒绝好友请求
+	OperateTypeCancelFriend                               // 撤回好友请求
+	OperateTypeListFriendRequest                          // 好友请求列表
+	OperateTypeBlock                                      // 拉黑
+	OperateTypeUnblock                                    // 取消拉黑
+	OperateTypeListBlocked                                // 黑名单
+	OperateTypeSetPrivacy                                 // 设置隐私
+	OperateTypeGetPrivacy                                 // 查看隐私设置
+	OperateTypeResume                                     // 断线重连后恢复会话
+	OperateTypeListSessions                               // 登录设备列表
+	OperateTypeRevokeSession                              // 下线其他设备
 )
 
+var operateText = map[OperateType]string{
+	OperateTypeRegister:            "register",
+	OperateTypeLogin:               "login",
+	OperateTypeLogout:              "logout",
+	OperateTypeDelete:              "delete",
+	OperateTypeSearchFriend:        "search friend",
+	OperateTypeMakeFriend:          "make friend",
+	OperateTypeDeleteFriend:        "delete friend",
+	OperateTypeListFriend:          "list friend",
+	OperateTypeCreateGroup:         "create group",
+	OperateTypeJoinGroup:           "join group",
+	OperateTypeLeaveGroup:          "leave group",
+	OperateTypeInviteGroup:         "invite group",
+	OperateTypeListGroupMember:     "list group member",
+	OperateTypeHistory:             "history",
+	OperateTypeSubscribePresence:   "subscribe presence",
+	OperateTypeUnsubscribePresence: "unsubscribe presence",
+	OperateTypeSetPresence:         "set presence",
+	OperateTypeAcceptFriend:        "accept friend",
+	OperateTypeRejectFriend:        "reject friend",
+	OperateTypeCancelFriend:        "cancel friend",
+	OperateTypeListFriendRequest:   "list friend request",
+	OperateTypeBlock:               "block",
+	OperateTypeUnblock:             "unblock",
+	OperateTypeListBlocked:         "list blocked",
+	OperateTypeSetPrivacy:          "set privacy",
+	OperateTypeGetPrivacy:          "get privacy",
+	OperateTypeResume:              "resume",
+	OperateTypeListSessions:        "list sessions",
+	OperateTypeRevokeSession:       "revoke session",
+}
+
+func (o OperateType) String() string {
+	if s, ok := operateText[o]; ok {
+		return s
+	}
+	return fmt.Sprintf("operate(%d)", byte(o))
+}
+
 type ServerMetadata struct {
 	Operate      OperateType
 	Username     string
@@ -146,39 +328,205 @@ type ServerMetadata struct {
 	Passwd       string
 	DestUsername string
 	DestUserID   string
+	Token        string
+	GroupID      string
+	GroupName    string
+	GroupKind    group.Kind
+	// BeforeID, AfterID and Limit page through the history of the
+	// conversation with DestUserID or GroupID.
+	BeforeID int64
+	AfterID  int64
+	Limit    int
+	// State and StatusText are the presence to set.
+	State      user.State
+	StatusText string
+	// Privacy is the privacy setting to set.
+	Privacy user.Privacy
+	// DeviceID and DeviceName identify the client logging in; DeviceID also
+	// picks the session to revoke.
+	DeviceID   string
+	DeviceName string
 }
 
-func PackMetadata(op OperateType, username, userid, passwd, destUsername, destUserID string) ([]byte, error) {
-	meta := &ServerMetadata{
-		Operate:  op,
-		Username: username,
-		Userid:   username,
-		Passwd:   passwd,
-	}
-	var buf = &bytes.Buffer{}
-	err := gob.NewEncoder(buf).Encode(meta)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+func PackMetadata(c Codec, meta *ServerMetadata) ([]byte, error) {
+	return c.Marshal(meta)
 }
 
-func UnpackMetadata(buf []byte) (ServerMetadata, error) {
+func UnpackMetadata(c Codec, buf []byte) (ServerMetadata, error) {
 	var res ServerMetadata
-	err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&res)
+	err := c.Unmarshal(buf, &res)
 	if err != nil {
 		return res, err
 	}
 	return res, nil
 }
 
-type UserList []*user.User
+// Presence is pushed to the friends of a user and to those who subscribed to
+// them whenever the state of the user changes. It is also the answer to a
+// subscription.
+type Presence struct {
+	UserID     string
+	State      user.State
+	StatusText string
+	LastSeen   int64
+}
+
+func PresenceOf(u user.BriefUser) Presence {
+	return Presence{
+		UserID:     u.ID,
+		State:      u.State,
+		StatusText: u.StatusText,
+		LastSeen:   u.LastSeen,
+	}
+}
+
+func PackPresence(c Codec, p *Presence) ([]byte, error) {
+	return c.Marshal(p)
+}
+
+func UnpackPresence(c Codec, data []byte) (p Presence, err error) {
+	err = c.Unmarshal(data, &p)
+	return p, err
+}
+
+func PackPrivacy(c Codec, p *user.Privacy) ([]byte, error) {
+	return c.Marshal(p)
+}
+
+func UnpackPrivacy(c Codec, data []byte) (p user.Privacy, err error) {
+	err = c.Unmarshal(data, &p)
+	return p, err
+}
+
+// FriendRequests lists the pending friend requests of a user.
+type FriendRequests struct {
+	Incoming []user.BriefUser
+	Outgoing []user.BriefUser
+}
 
-func (l *UserList) Marshal() (res []byte, err error) {
-	err = gob.NewEncoder(bytes.NewBuffer(res)).Encode(l)
+func (r *FriendRequests) Marshal(c Codec) ([]byte, error) {
+	return c.Marshal(r)
+}
+
+func (r *FriendRequests) Unmarshal(c Codec, buf []byte) error {
+	return c.Unmarshal(buf, r)
+}
+
+type FriendEventType byte
+
+const (
+	FriendRequested FriendEventType = iota + 1 // 收到好友请求
+	FriendAccepted                             // 好友请求已同意
+	FriendRejected                             // 好友请求被拒绝
+	FriendCanceled                             // 好友请求已撤回
+)
+
+var friendEventText = map[FriendEventType]string{
+	FriendRequested: "requested",
+	FriendAccepted:  "accepted",
+	FriendRejected:  "rejected",
+	FriendCanceled:  "canceled",
+}
+
+func (e FriendEventType) String() string {
+	if s, ok := friendEventText[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("friend event(%d)", byte(e))
+}
+
+// FriendEvent tells a user that UserID sent, accepted, rejected or canceled
+// a friend request to or from them.
+type FriendEvent struct {
+	Event  FriendEventType
+	UserID string
+	Name   string
+}
+
+func PackFriendEvent(c Codec, e *FriendEvent) ([]byte, error) {
+	return c.Marshal(e)
+}
+
+func UnpackFriendEvent(c Codec, data []byte) (e FriendEvent, err error) {
+	err = c.Unmarshal(data, &e)
+	return e, err
+}
+
+// LoginResult answers a login or resume. DeviceID is the one the client sent,
+// or the one the server assigned if it sent none.
+type LoginResult struct {
+	Token    string
+	DeviceID string
+}
+
+func PackLoginResult(c Codec, token, deviceID string) ([]byte, error) {
+	return c.Marshal(&LoginResult{
+		Token:    token,
+		DeviceID: deviceID,
+	})
+}
+
+func UnpackLoginResult(c Codec, data []byte) (res LoginResult, err error) {
+	err = c.Unmarshal(data, &res)
 	return res, err
 }
 
-func (l *UserList) Unmarshal(buf []byte) error {
-	return gob.NewDecoder(bytes.NewBuffer(buf)).Decode(l)
+// Session is a login of a user on one device. Since is the login time in
+// unix milliseconds, Current marks the session asking for the list.
+type Session struct {
+	DeviceID   string
+	DeviceName string
+	Addr       string
+	Since      int64
+	Current    bool
+}
+
+type SessionList []Session
+
+func (l *SessionList) Marshal(c Codec) ([]byte, error) {
+	return c.Marshal(l)
+}
+
+func (l *SessionList) Unmarshal(c Codec, buf []byte) error {
+	return c.Unmarshal(buf, l)
+}
+
+type UserList []user.BriefUser
+
+func (l *UserList) Marshal(c Codec) ([]byte, error) {
+	return c.Marshal(l)
+}
+
+func (l *UserList) Unmarshal(c Codec, buf []byte) error {
+	return c.Unmarshal(buf, l)
+}
+
+// ChatRecord is a chat message as accepted by the server, which assigns the
+// ID and the Time in unix milliseconds. IDs grow with every message.
+type ChatRecord struct {
+	ID          int64
+	SrcUserID   string
+	DestUserID  string
+	DestGroupID string
+	Body        []byte
+	Time        int64
+	// ClientMsgID and Seq are those of the chat header it was sent with.
+	ClientMsgID string
+	Seq         int
+}
+
+// HistoryPage is one page of the history of a conversation, oldest message
+// first. More reports whether there are further messages beyond the page in
+// the direction that was asked for.
+type HistoryPage struct {
+	Messages []ChatRecord
+	More     bool
+}
+
+func (p *HistoryPage) Marshal(c Codec) ([]byte, error) {
+	return c.Marshal(p)
+}
+
+func (p *HistoryPage) Unmarshal(c Codec, buf []byte) error {
+	return c.Unmarshal(buf, p)
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"sort"
+	"time"
 )
 
 type State byte
@@ -11,29 +12,131 @@ type State byte
 const (
 	Offline State = iota
 	Online
+	Away
+	Busy
+	DoNotDisturb
+	// Invisible users are online but shown to others as Offline.
+	Invisible
 )
 
+var stateText = map[State]string{
+	Offline:      "offline",
+	Online:       "online",
+	Away:         "away",
+	Busy:         "busy",
+	DoNotDisturb: "dnd",
+	Invisible:    "invisible",
+}
+
+func (s State) String() string {
+	if t, ok := stateText[s]; ok {
+		return t
+	}
+	return "unknown"
+}
+
+// ParseState is the reverse of String.
+func ParseState(text string) (State, bool) {
+	for s, t := range stateText {
+		if t == text {
+			return s, true
+		}
+	}
+	return Offline, false
+}
+
+// rank orders the states for SortFriend, the most reachable first.
+func (s State) rank() int {
+	switch s {
+	case Online:
+		return 4
+	case Away:
+		return 3
+	case Busy:
+		return 2
+	case DoNotDisturb:
+		return 1
+	}
+	return 0
+}
+
+// Audience is who may do something with a user; users blocked by the user
+// are never part of it.
+type Audience byte
+
+const (
+	Everyone Audience = iota
+	Friends
+	Nobody
+)
+
+var audienceText = map[Audience]string{
+	Everyone: "everyone",
+	Friends:  "friends",
+	Nobody:   "nobody",
+}
+
+func (a Audience) String() string {
+	if t, ok := audienceText[a]; ok {
+		return t
+	}
+	return "unknown"
+}
+
+// ParseAudience is the reverse of String.
+func ParseAudience(text string) (Audience, bool) {
+	for a, t := range audienceText {
+		if t == text {
+			return a, true
+		}
+	}
+	return Everyone, false
+}
+
+// Privacy says who may find a user with a search, send them friend requests
+// and see their presence. The zero value lets everyone do all of it.
+type Privacy struct {
+	Search        Audience
+	FriendRequest Audience
+	Presence      Audience
+}
+
 type User struct {
-	id      string
-	name    string
-	pwd     string
-	state   State
-	friends map[string]string
+	id         string
+	name       string
+	pwd        string
+	state      State
+	statusText string
+	lastSeen   int64
+	friends    map[string]string
+	// pending friend requests by the id of the other user
+	requestsIn  map[string]struct{}
+	requestsOut map[string]struct{}
+	blocked     map[string]struct{}
+	privacy     Privacy
 }
 
+// BriefUser is a user as seen by others: an Invisible user is shown as
+// Offline. LastSeen is when the user last went offline, in unix
+// milliseconds.
 type BriefUser struct {
-	ID    string
-	Name  string
-	State State
+	ID         string
+	Name       string
+	State      State
+	StatusText string
+	LastSeen   int64
 }
 
 func NewUser(id, name, pwd string, state State) *User {
 	return &User{
-		id:      id,
-		name:    name,
-		pwd:     pwd,
-		state:   state,
-		friends: make(map[string]string),
+		id:          id,
+		name:        name,
+		pwd:         pwd,
+		state:       state,
+		friends:     make(map[string]string),
+		requestsIn:  make(map[string]struct{}),
+		requestsOut: make(map[string]struct{}),
+		blocked:     make(map[string]struct{}),
 	}
 }
 
@@ -49,22 +152,159 @@ func (u *User) Pwd() string {
 	return u.pwd
 }
 
+// SetPwd replaces the stored password hash.
+func (u *User) SetPwd(pwd string) {
+	u.pwd = pwd
+}
+
 func (u *User) State() State {
 	return u.state
 }
 
+func (u *User) Brief() BriefUser {
+	b := BriefUser{
+		ID:         u.id,
+		Name:       u.name,
+		State:      u.state,
+		StatusText: u.statusText,
+		LastSeen:   u.lastSeen,
+	}
+	if b.State == Invisible {
+		b.State = Offline
+	}
+	return b
+}
+
+// BriefFor is the user as seen by viewer, without the presence unless the
+// Presence privacy admits viewer.
+func (u *User) BriefFor(viewer string) BriefUser {
+	b := u.Brief()
+	if !u.Admits(u.privacy.Presence, viewer) {
+		b.State = Offline
+		b.StatusText = ""
+		b.LastSeen = 0
+	}
+	return b
+}
+
+// SetState changes the state, remembering when the user went offline.
 func (u *User) SetState(state State) {
+	if state == Offline && u.state != Offline {
+		u.lastSeen = time.Now().UnixNano() / int64(time.Millisecond)
+	}
 	u.state = state
 }
 
+func (u *User) StatusText() string {
+	return u.statusText
+}
+
+func (u *User) SetStatusText(text string) {
+	u.statusText = text
+}
+
+func (u *User) LastSeen() int64 {
+	return u.lastSeen
+}
+
 func (u *User) AddFriend(userid, username string) {
 	u.friends[userid] = username
 }
 
+func (u *User) HasFriend(userid string) bool {
+	_, ok := u.friends[userid]
+	return ok
+}
+
 func (u *User) DelFriend(userid string) {
 	delete(u.friends, userid)
 }
 
+func (u *User) AddRequestIn(userid string) {
+	u.requestsIn[userid] = struct{}{}
+}
+
+func (u *User) AddRequestOut(userid string) {
+	u.requestsOut[userid] = struct{}{}
+}
+
+func (u *User) HasRequestIn(userid string) bool {
+	_, ok := u.requestsIn[userid]
+	return ok
+}
+
+func (u *User) HasRequestOut(userid string) bool {
+	_, ok := u.requestsOut[userid]
+	return ok
+}
+
+func (u *User) DelRequestIn(userid string) {
+	delete(u.requestsIn, userid)
+}
+
+func (u *User) DelRequestOut(userid string) {
+	delete(u.requestsOut, userid)
+}
+
+// ListRequest returns the ids of the users who asked u to be friends and of
+// those u asked, sorted.
+func (u *User) ListRequest() (in, out []string) {
+	return sortedKeys(u.requestsIn), sortedKeys(u.requestsOut)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (u *User) Block(userid string) {
+	u.blocked[userid] = struct{}{}
+}
+
+func (u *User) Unblock(userid string) {
+	delete(u.blocked, userid)
+}
+
+func (u *User) HasBlocked(userid string) bool {
+	_, ok := u.blocked[userid]
+	return ok
+}
+
+// ListBlocked returns the ids of the users u blocked, sorted.
+func (u *User) ListBlocked() []string {
+	return sortedKeys(u.blocked)
+}
+
+func (u *User) Privacy() Privacy {
+	return u.privacy
+}
+
+func (u *User) SetPrivacy(p Privacy) {
+	u.privacy = p
+}
+
+// Admits reports whether viewer is part of the audience a of u. Users always
+// admit themselves.
+func (u *User) Admits(a Audience, viewer string) bool {
+	if viewer == u.id {
+		return true
+	}
+	if u.HasBlocked(viewer) {
+		return false
+	}
+	switch a {
+	case Everyone:
+		return true
+	case Friends:
+		return u.HasFriend(viewer)
+	}
+	return false
+}
+
 func (u *User) ListFriend() []BriefUser {
 	res := make([]BriefUser, 0, len(u.friends))
 	for id, name := range u.friends {
@@ -79,21 +319,82 @@ func (u *User) ListFriend() []BriefUser {
 
 func (u *User) SortFriend(us []BriefUser) {
 	sort.Slice(us, func(i, j int) bool {
-		if us[i].State > us[j].State {
-			return true
-		}
-		if us[i].State == us[j].State {
-			return us[i].ID < us[j].ID
+		ri, rj := us[i].State.rank(), us[j].State.rank()
+		if ri != rj {
+			return ri > rj
 		}
-		return false
+		return us[i].ID < us[j].ID
 	})
 }
 
-func (u *User) Marshal() (buf []byte, err error) {
-	err = gob.NewEncoder(bytes.NewBuffer(buf)).Encode(u)
-	return buf, err
+// Record is the persistent form of a User; the online state is not part of it.
+type Record struct {
+	ID          string
+	Name        string
+	Pwd         string
+	Friends     map[string]string
+	StatusText  string
+	LastSeen    int64
+	RequestsIn  []string
+	RequestsOut []string
+	Blocked     []string
+	Privacy     Privacy
+}
+
+func (u *User) Record() Record {
+	friends := make(map[string]string, len(u.friends))
+	for id, name := range u.friends {
+		friends[id] = name
+	}
+	return Record{
+		ID:          u.id,
+		Name:        u.name,
+		Pwd:         u.pwd,
+		Friends:     friends,
+		StatusText:  u.statusText,
+		LastSeen:    u.lastSeen,
+		RequestsIn:  sortedKeys(u.requestsIn),
+		RequestsOut: sortedKeys(u.requestsOut),
+		Blocked:     sortedKeys(u.blocked),
+		Privacy:     u.privacy,
+	}
+}
+
+func FromRecord(r Record) *User {
+	u := NewUser(r.ID, r.Name, r.Pwd, Offline)
+	u.statusText = r.StatusText
+	u.lastSeen = r.LastSeen
+	for id, name := range r.Friends {
+		u.friends[id] = name
+	}
+	for _, id := range r.RequestsIn {
+		u.requestsIn[id] = struct{}{}
+	}
+	for _, id := range r.RequestsOut {
+		u.requestsOut[id] = struct{}{}
+	}
+	for _, id := range r.Blocked {
+		u.blocked[id] = struct{}{}
+	}
+	u.privacy = r.Privacy
+	return u
+}
+
+func (u *User) Marshal() ([]byte, error) {
+	var buf = &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(u.Record())
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func (u *User) Unmarshal(buf []byte) error {
-	return gob.NewDecoder(bytes.NewBuffer(buf)).Decode(u)
+	var r Record
+	err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(&r)
+	if err != nil {
+		return err
+	}
+	*u = *FromRecord(r)
+	return nil
 }
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+var (
+	ErrWeakPassword    = errors.New("password does not satisfy the policy")
+	ErrInvalidPassword = errors.New("invalid password")
+	errMalformedHash   = errors.New("malformed password hash")
+)
+
+// HashParams are the argon2id parameters of newly hashed passwords. Memory
+// is in KiB.
+type HashParams struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+type Hasher struct {
+	params HashParams
+
+	dummyOnce sync.Once
+	dummy     string
+}
+
+func NewHasher(params HashParams) *Hasher {
+	return &Hasher{params: params}
+}
+
+// Hash returns pwd hashed with a random salt, encoded in the PHC string
+// format together with the parameters used:
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>.
+func (h *Hasher) Hash(pwd string) (string, error) {
+	salt := make([]byte, h.params.SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	p := h.params
+	key := argon2.IDKey([]byte(pwd), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify compares pwd with the stored hash in constant time. rehash reports
+// that the hash was made with other parameters than the current ones, or is
+// a plaintext password stored before hashing was introduced, and should be
+// replaced by Hash(pwd) now that the password is known.
+func (h *Hasher) Verify(encoded, pwd string) (ok bool, rehash bool, err error) {
+	if !strings.HasPrefix(encoded, argon2idPrefix) {
+		ok = subtle.ConstantTimeCompare([]byte(encoded), []byte(pwd)) == 1
+		return ok, ok, nil
+	}
+	p, salt, key, err := decodeHash(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	other := argon2.IDKey([]byte(pwd), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	ok = subtle.ConstantTimeCompare(key, other) == 1
+	rehash = p != h.params
+	return ok, ok && rehash, nil
+}
+
+// VerifyDummy runs Verify of pwd against a hash with the current parameters
+// and throws the result away. It stands in for the check of a user that does
+// not exist, so that the response time does not tell whether it does.
+func (h *Hasher) VerifyDummy(pwd string) {
+	h.dummyOnce.Do(func() {
+		secret := make([]byte, 16)
+		if _, err := rand.Read(secret); err != nil {
+			return
+		}
+		h.dummy, _ = h.Hash(base64.RawStdEncoding.EncodeToString(secret))
+	})
+	if h.dummy != "" {
+		_, _, _ = h.Verify(h.dummy, pwd)
+	}
+}
+
+func decodeHash(encoded string) (p HashParams, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, errMalformedHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, errMalformedHash
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, errMalformedHash
+	}
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, errMalformedHash
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, errMalformedHash
+	}
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+	return p, salt, key, nil
+}
+
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireLetter bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+func (p PasswordPolicy) Validate(pwd string) error {
+	n := len([]rune(pwd))
+	if n < p.MinLength {
+		return fmt.Errorf("%w: at least %d characters", ErrWeakPassword, p.MinLength)
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		return fmt.Errorf("%w: at most %d characters", ErrWeakPassword, p.MaxLength)
+	}
+	var letter, digit, symbol bool
+	for _, r := range pwd {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+	if p.RequireLetter && !letter {
+		return fmt.Errorf("%w: a letter is required", ErrWeakPassword)
+	}
+	if p.RequireDigit && !digit {
+		return fmt.Errorf("%w: a digit is required", ErrWeakPassword)
+	}
+	if p.RequireSymbol && !symbol {
+		return fmt.Errorf("%w: a symbol is required", ErrWeakPassword)
+	}
+	return nil
+}
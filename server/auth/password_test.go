@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testParams keep the tests fast, they are far below what a server uses.
+var testParams = HashParams{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+func TestHashVerify(t *testing.T) {
+	h := NewHasher(testParams)
+	hash, err := h.Hash("secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("hash %s", hash)
+	}
+	if other, _ := h.Hash("secret1"); other == hash {
+		t.Fatal("two hashes of a password are the same, the salt is not random")
+	}
+
+	ok, rehash, err := h.Verify(hash, "secret1")
+	if err != nil || !ok || rehash {
+		t.Fatalf("verify right password: ok %v, rehash %v, err: %v", ok, rehash, err)
+	}
+	ok, rehash, err = h.Verify(hash, "secret2")
+	if err != nil || ok || rehash {
+		t.Fatalf("verify wrong password: ok %v, rehash %v, err: %v", ok, rehash, err)
+	}
+
+	for _, malformed := range []string{
+		"$argon2id$",
+		"$argon2id$v=19$m=64,t=1,p=1$!!$AAAA",
+		"$argon2id$v=19$m=x,t=1,p=1$AAAA$AAAA",
+		"$argon2id$v=18$m=64,t=1,p=1$AAAA$AAAA",
+	} {
+		if ok, _, err = h.Verify(malformed, "secret1"); ok || err == nil {
+			t.Errorf("verify against %s: ok %v, err: %v", malformed, ok, err)
+		}
+	}
+}
+
+func TestVerifyRehash(t *testing.T) {
+	hash, err := NewHasher(testParams).Hash("secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stronger := testParams
+	stronger.Time = 2
+	h := NewHasher(stronger)
+
+	ok, rehash, err := h.Verify(hash, "secret1")
+	if err != nil || !ok || !rehash {
+		t.Fatalf("verify hash of old parameters: ok %v, rehash %v, err: %v", ok, rehash, err)
+	}
+	// a wrong password says nothing about the hash
+	if ok, rehash, _ = h.Verify(hash, "secret2"); ok || rehash {
+		t.Fatalf("verify wrong password: ok %v, rehash %v", ok, rehash)
+	}
+}
+
+func TestVerifyLegacy(t *testing.T) {
+	h := NewHasher(testParams)
+	ok, rehash, err := h.Verify("secret1", "secret1")
+	if err != nil || !ok || !rehash {
+		t.Fatalf("verify plaintext password: ok %v, rehash %v, err: %v", ok, rehash, err)
+	}
+	ok, rehash, err = h.Verify("secret1", "secret2")
+	if err != nil || ok || rehash {
+		t.Fatalf("verify wrong plaintext password: ok %v, rehash %v, err: %v", ok, rehash, err)
+	}
+}
+
+func TestVerifyDummy(t *testing.T) {
+	h := NewHasher(testParams)
+	h.VerifyDummy("secret1")
+	if !strings.HasPrefix(h.dummy, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("dummy hash %q", h.dummy)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, MaxLength: 16, RequireLetter: true, RequireDigit: true, RequireSymbol: true}
+	for pwd, valid := range map[string]bool{
+		"abc1!":             false,
+		"abcdefgh1!":        true,
+		"abcdefghijklmn1!x": false,
+		"12345678!":         false,
+		"abcdefgh!":         false,
+		"abcdefgh1":         false,
+		"пароль12!":         true,
+	} {
+		err := policy.Validate(pwd)
+		if valid && err != nil || !valid && !errors.Is(err, ErrWeakPassword) {
+			t.Errorf("validate %q, err: %v", pwd, err)
+		}
+	}
+
+	// the length counts characters, not bytes
+	if err := (PasswordPolicy{MaxLength: 8}).Validate("пароль12"); err != nil {
+		t.Errorf("8 characters of 14 bytes, err: %v", err)
+	}
+	if err := (PasswordPolicy{}).Validate(""); err != nil {
+		t.Errorf("empty policy, err: %v", err)
+	}
+}
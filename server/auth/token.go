@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrTokenExpired = errors.New("session token expired")
+)
+
+// TokenIssuer issues session tokens of the form payload.signature, where the
+// payload is userid|expiry|nonce and the signature its HMAC-SHA256, both
+// base64url encoded. Revoked tokens are remembered until they expire.
+type TokenIssuer struct {
+	secret []byte
+	ttl    time.Duration
+	store  RevocationStore
+
+	mu sync.Mutex
+	// revoked maps the ids of revoked tokens to their expiry
+	revoked map[string]int64
+}
+
+// RevocationStore keeps revoked tokens across restarts, by the SHA-256 of
+// the token in hex, until their expiry in unix seconds.
+type RevocationStore interface {
+	RevokeToken(id string, expiry int64) error
+	RevokedTokens() map[string]int64
+}
+
+// NewTokenIssuer creates an issuer signing with secret. An empty secret is
+// replaced by a random one, so tokens do not survive a restart. Revocations
+// are loaded from and written to store, if not nil.
+func NewTokenIssuer(secret string, ttl time.Duration, store RevocationStore) (*TokenIssuer, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	t := &TokenIssuer{secret: key, ttl: ttl, store: store, revoked: make(map[string]int64)}
+	if store != nil {
+		for id, expiry := range store.RevokedTokens() {
+			t.revoked[id] = expiry
+		}
+	}
+	return t, nil
+}
+
+// LoadSecret returns the secret kept in the file at path, creating the file
+// with a random secret if there is none yet.
+func LoadSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(key)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		// created by someone else in the meantime
+		return LoadSecret(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(secret + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (t *TokenIssuer) Issue(userid string) (string, error) {
+	nonce := make([]byte, 12)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	payload := strings.Join([]string{
+		userid,
+		strconv.FormatInt(time.Now().Add(t.ttl).Unix(), 10),
+		base64.RawURLEncoding.EncodeToString(nonce),
+	}, "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(t.sign([]byte(payload))), nil
+}
+
+// Verify checks the signature and expiry of token and that it was not
+// revoked, and returns the user it was issued to.
+func (t *TokenIssuer) Verify(token string) (userid string, err error) {
+	userid, _, err = t.verify(token)
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	_, revoked := t.revoked[tokenID(token)]
+	t.mu.Unlock()
+	if revoked {
+		return "", ErrUnauthorized
+	}
+	return userid, nil
+}
+
+// Revoke makes token invalid before it expires. A token that is invalid
+// already is left alone.
+func (t *TokenIssuer) Revoke(token string) error {
+	_, expiry, err := t.verify(token)
+	if err != nil {
+		return nil
+	}
+	id := tokenID(token)
+	now := time.Now().Unix()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, exp := range t.revoked {
+		if now > exp {
+			delete(t.revoked, k)
+		}
+	}
+	t.revoked[id] = expiry
+	if t.store == nil {
+		return nil
+	}
+	return t.store.RevokeToken(id, expiry)
+}
+
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *TokenIssuer) verify(token string) (userid string, expiry int64, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", 0, ErrUnauthorized
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", 0, ErrUnauthorized
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", 0, ErrUnauthorized
+	}
+	if !hmac.Equal(sig, t.sign(payload)) {
+		return "", 0, ErrUnauthorized
+	}
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 3 {
+		return "", 0, ErrUnauthorized
+	}
+	expiry, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", 0, ErrUnauthorized
+	}
+	if time.Now().Unix() > expiry {
+		return "", 0, ErrTokenExpired
+	}
+	return fields[0], expiry, nil
+}
+
+func (t *TokenIssuer) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"encoding/base64"
+	"github.com/byronzhu-haha/chat/server/repo"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newIssuer(t *testing.T, secret string, ttl time.Duration, store RevocationStore) *TokenIssuer {
+	t.Helper()
+	issuer, err := NewTokenIssuer(secret, ttl, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func issue(t *testing.T, issuer *TokenIssuer, userid string) string {
+	t.Helper()
+	token, err := issuer.Issue(userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestIssueVerify(t *testing.T) {
+	issuer := newIssuer(t, "secret", time.Hour, nil)
+	token := issue(t, issuer, "alice")
+	userid, err := issuer.Verify(token)
+	if err != nil || userid != "alice" {
+		t.Fatalf("verify gave %q, err: %v", userid, err)
+	}
+	if other := issue(t, issuer, "alice"); other == token {
+		t.Fatal("two tokens of a user are the same")
+	}
+
+	// an empty secret is random, tokens do not carry over
+	a, b := newIssuer(t, "", time.Hour, nil), newIssuer(t, "", time.Hour, nil)
+	if _, err = b.Verify(issue(t, a, "alice")); err != ErrUnauthorized {
+		t.Fatalf("token of another random secret verified, err: %v", err)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	issuer := newIssuer(t, "secret", time.Hour, nil)
+	token := issue(t, issuer, "alice")
+	parts := strings.Split(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[0] ^= 1
+	forged := strings.Replace(string(payload), "alice", "mallory", 1)
+
+	for name, tampered := range map[string]string{
+		"signature":      parts[0] + "." + base64.RawURLEncoding.EncodeToString(sig),
+		"payload":        base64.RawURLEncoding.EncodeToString([]byte(forged)) + "." + parts[1],
+		"other secret":   issue(t, newIssuer(t, "other", time.Hour, nil), "alice"),
+		"no signature":   parts[0],
+		"empty":          "",
+		"extra part":     token + ".x",
+		"not base64":     "!!." + parts[1],
+		"bad signature":  parts[0] + ".!!",
+		"payload fields": base64.RawURLEncoding.EncodeToString([]byte("alice")) + "." + base64.RawURLEncoding.EncodeToString(issuer.sign([]byte("alice"))),
+	} {
+		if userid, err := issuer.Verify(tampered); err != ErrUnauthorized {
+			t.Errorf("%s: verify gave %q, err: %v", name, userid, err)
+		}
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	issuer := newIssuer(t, "secret", -2*time.Second, nil)
+	if _, err := issuer.Verify(issue(t, issuer, "alice")); err != ErrTokenExpired {
+		t.Fatalf("verify expired token, err: %v", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	issuer := newIssuer(t, "secret", time.Hour, nil)
+	revoked, kept := issue(t, issuer, "alice"), issue(t, issuer, "alice")
+	if err := issuer.Revoke(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuer.Verify(revoked); err != ErrUnauthorized {
+		t.Fatalf("verify revoked token, err: %v", err)
+	}
+	if _, err := issuer.Verify(kept); err != nil {
+		t.Fatalf("revoking a token revoked another, err: %v", err)
+	}
+	if err := issuer.Revoke("garbage"); err != nil {
+		t.Fatalf("revoke invalid token, err: %v", err)
+	}
+}
+
+func TestRevokePersists(t *testing.T) {
+	dir := t.TempDir()
+	users, err := repo.NewFileUserManager(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := newIssuer(t, "secret", time.Hour, users)
+	revoked, kept := issue(t, issuer, "alice"), issue(t, issuer, "alice")
+	if err = issuer.Revoke(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if err = users.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err = repo.NewFileUserManager(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer users.Close()
+	issuer = newIssuer(t, "secret", time.Hour, users)
+	if _, err = issuer.Verify(revoked); err != ErrUnauthorized {
+		t.Fatalf("verify token revoked before the restart, err: %v", err)
+	}
+	if _, err = issuer.Verify(kept); err != nil {
+		t.Fatalf("verify token kept over the restart, err: %v", err)
+	}
+}
+
+func TestLoadSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.key")
+	secret, err := LoadSecret(path)
+	if err != nil || len(secret) != 64 {
+		t.Fatalf("created secret %q, err: %v", secret, err)
+	}
+	again, err := LoadSecret(path)
+	if err != nil || again != secret {
+		t.Fatalf("loaded secret %q, want %q, err: %v", again, secret, err)
+	}
+}
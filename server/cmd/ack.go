@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/server/conn"
+	"github.com/byronzhu-haha/log"
+)
+
+// transferAck forwards a delivered ack or a read receipt of a recipient to
+// the devices of the sender of the message that take acks.
+func (s *ChatServer) transferAck(r conn.Request) {
+	ack, err := message.UnpackAck(r.Codec, r.Msg.Body)
+	if err != nil {
+		log.Errorf("unpack ack failed, err: %+v", err)
+		return
+	}
+	want := message.AckDelivered
+	if r.Msg.IsReceiptMsg() {
+		want = message.AckRead
+	}
+	if ack.Status != want {
+		log.Warnf("drop %s from %s as message type %d", ack.Status, r.Addr, r.Msg.MsgType)
+		return
+	}
+	uid, _, ok := s.connManager.Session(r.Addr)
+	if !ok {
+		log.Warnf("drop %s from %s, not logged in", ack.Status, r.Addr)
+		return
+	}
+	rec, err := s.history.Get(ack.MsgID)
+	if err != nil {
+		log.Warnf("drop %s of message %d from user(%s), err: %+v", ack.Status, ack.MsgID, uid, err)
+		return
+	}
+	if !s.isRecipient(uid, rec) {
+		log.Warnf("drop %s of message %d from user(%s), not a recipient", ack.Status, ack.MsgID, uid)
+		return
+	}
+
+	s.connManager.SendAckToUser(rec.SrcUserID, ackPacker(r.Msg.MsgType, message.Ack{
+		Status:  ack.Status,
+		MsgID:   rec.ID,
+		UserID:  uid,
+		GroupID: rec.DestGroupID,
+	}))
+}
+
+func (s *ChatServer) isRecipient(userid string, rec message.ChatRecord) bool {
+	if userid == rec.SrcUserID {
+		return false
+	}
+	if rec.DestGroupID == "" {
+		return userid == rec.DestUserID
+	}
+	ok, err := s.groupRepo.IsMember(rec.DestGroupID, userid)
+	return err == nil && ok
+}
+
+func ackPacker(msgType message.MsgType, ack message.Ack) conn.Packer {
+	return func(c message.Codec) ([]byte, error) {
+		body, err := message.PackAck(c, &ack)
+		if err != nil {
+			return nil, err
+		}
+		return message.Pack(c, msgType, nil, body)
+	}
+}
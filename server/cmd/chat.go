@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/server/auth"
+	"github.com/byronzhu-haha/chat/server/conn"
+	"github.com/byronzhu-haha/chat/server/repo"
+	"github.com/byronzhu-haha/log"
+)
+
+// transferChat records a chat message in the history, acks it to the sender
+// and forwards it to its recipients on all their devices, keeping it in the
+// inbox of those who are offline until their next login. The other devices
+// of the sender get a copy too.
+func (s *ChatServer) transferChat(r conn.Request) {
+	head, err := message.UnpackChatHeader(r.Codec, r.Msg.Head)
+	if err != nil {
+		log.Errorf("unmarshal header failed, err: %+v", err)
+		return
+	}
+	if id, ok := s.sentBefore(r.Addr, head.ClientMsgID); ok {
+		// the client sent it again after a reconnect, the first one went
+		// through already
+		ack := message.Ack{Status: message.AckAccepted, Seq: head.Seq, MsgID: id}
+		_ = s.connManager.SendAck(r.Addr, ackPacker(message.MsgTypeAck, ack))
+		return
+	}
+	rec, members, err := s.acceptChat(r.Addr, head, r.Msg.Body)
+	ack := message.Ack{Status: message.AckAccepted, Seq: head.Seq, MsgID: rec.ID}
+	if err != nil {
+		log.Warnf("reject chat from %s, err: %+v", r.Addr, err)
+		ack.Status = message.AckRejected
+		ack.Code = codeOf(err)
+	}
+	_ = s.connManager.SendAck(r.Addr, ackPacker(message.MsgTypeAck, ack))
+	if err != nil {
+		return
+	}
+	s.connManager.SendToOthers(rec.SrcUserID, r.Addr, chatPacker(rec))
+	for _, member := range members {
+		if member == rec.SrcUserID {
+			continue
+		}
+		rec.DestUserID = member
+		s.deliver(rec)
+	}
+}
+
+// sentBefore returns the id of the chat message with clientID that the user
+// logged in at addr sent before, if any.
+func (s *ChatServer) sentBefore(addr, clientID string) (int64, bool) {
+	if clientID == "" {
+		return 0, false
+	}
+	userid, _, ok := s.connManager.Session(addr)
+	if !ok {
+		return 0, false
+	}
+	return s.history.Sent(userid, clientID)
+}
+
+// acceptChat checks that the chat message may be sent, records it and returns
+// it along with its recipients.
+func (s *ChatServer) acceptChat(addr string, head message.ChatHeader, body []byte) (rec message.ChatRecord, members []string, err error) {
+	// the sender is whoever is logged in on the connection, not the user id
+	// the client claims
+	src, _, ok := s.connManager.Session(addr)
+	if !ok {
+		return rec, nil, auth.ErrUnauthorized
+	}
+	if head.DestGroupID == "" {
+		dest, err := s.userRepo.Get(head.DestUserID)
+		if err != nil {
+			return rec, nil, err
+		}
+		if dest.HasBlocked(src) {
+			return rec, nil, errForbidden
+		}
+		members = []string{head.DestUserID}
+	} else {
+		members, err = s.groupRepo.Members(head.DestGroupID)
+		if err != nil {
+			return rec, nil, err
+		}
+		if !contains(members, src) {
+			return rec, nil, errForbidden
+		}
+		members = s.notBlocking(members, src)
+	}
+	rec, err = s.history.Append(message.ChatRecord{
+		SrcUserID:   src,
+		DestUserID:  head.DestUserID,
+		DestGroupID: head.DestGroupID,
+		Body:        body,
+		ClientMsgID: head.ClientMsgID,
+		Seq:         head.Seq,
+	})
+	return rec, members, err
+}
+
+// notBlocking returns the users of ids who have not blocked userid.
+func (s *ChatServer) notBlocking(ids []string, userid string) []string {
+	res := make([]string, 0, len(ids))
+	for _, id := range ids {
+		u, err := s.userRepo.Get(id)
+		if err == nil && u.HasBlocked(userid) {
+			continue
+		}
+		res = append(res, id)
+	}
+	return res
+}
+
+// deliver sends rec to its recipient if they are online and keeps it in their
+// inbox otherwise.
+func (s *ChatServer) deliver(rec message.ChatRecord) {
+	if s.sendToUser(rec.DestUserID, chatPacker(rec)) {
+		return
+	}
+	s.keepOffline([]message.ChatRecord{rec})
+}
+
+// sendToUser sends the messages to the connections userid is logged in on,
+// wherever they connect from, and reports whether there was any.
+func (s *ChatServer) sendToUser(userid string, packs ...conn.Packer) bool {
+	return s.connManager.SendToUser(userid, packs...) > 0
+}
+
+// online reports whether userid is logged in on any connection.
+func (s *ChatServer) online(userid string) bool {
+	return len(s.connManager.UserConns(userid)) > 0
+}
+
+func (s *ChatServer) keepOffline(msgs []message.ChatRecord) {
+	for _, msg := range msgs {
+		err := s.inbox.Push(msg.DestUserID, msg)
+		if err != nil {
+			log.Errorf("keep offline message for user(%s) failed, err: %+v", msg.DestUserID, err)
+		}
+	}
+}
+
+func chatPacker(msg message.ChatRecord) conn.Packer {
+	return func(c message.Codec) ([]byte, error) {
+		head, err := message.PackChatHeader(c, &message.ChatHeader{
+			SrcUserID:   msg.SrcUserID,
+			DestUserID:  msg.DestUserID,
+			DestGroupID: msg.DestGroupID,
+			Seq:         msg.Seq,
+			MsgID:       msg.ID,
+			Time:        msg.Time,
+			ClientMsgID: msg.ClientMsgID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return message.Pack(c, message.MsgTypeChat, head, msg.Body)
+	}
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// History returns a page of the conversation of userid with destUserID, or
+// of the group groupID if that is set.
+func (s *ChatServer) History(c message.Codec, userid string, meta message.ServerMetadata) (resp []byte, err error) {
+	var conv string
+	if meta.GroupID != "" {
+		err = s.checkMember(userid, meta.GroupID)
+		if err != nil {
+			return resp, err
+		}
+		conv = repo.GroupConversation(meta.GroupID)
+	} else {
+		conv = repo.UserConversation(userid, meta.DestUserID)
+	}
+	limit := meta.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	var page message.HistoryPage
+	page.Messages, page.More, err = s.history.Query(conv, meta.BeforeID, meta.AfterID, limit)
+	if err != nil {
+		return resp, err
+	}
+	return page.Marshal(c)
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"github.com/byronzhu-haha/chat/entity/message"
+	"testing"
+)
+
+func TestChatRoutedBySession(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := s.register("alice"), s.register("bob")
+	phone, laptop, b := s.dial(), s.dial(), s.dial()
+	phone.login(alice, "phone")
+	laptop.login(alice, "laptop")
+	b.login(bob, "phone")
+
+	// the sender is who is logged in on the connection, whatever the
+	// header claims, and the message reaches every device of the recipient
+	ack := b.chatWith(message.ChatHeader{SrcUserID: alice, DestUserID: alice}, "hi")
+	if ack.Status != message.AckAccepted {
+		t.Fatalf("chat to alice acked with %+v", ack)
+	}
+	for _, c := range []*testClient{phone, laptop} {
+		head, text := c.readChat()
+		if head.SrcUserID != bob || head.MsgID != ack.MsgID || text != "hi" {
+			t.Fatalf("alice got %+v %q", head, text)
+		}
+	}
+
+	// the other devices of the sender get a copy, with the client message
+	// id of the original
+	ack = phone.chat(bob, "hello")
+	if ack.Status != message.AckAccepted {
+		t.Fatalf("chat to bob acked with %+v", ack)
+	}
+	got, _ := b.readChat()
+	copied, text := laptop.readChat()
+	if got.SrcUserID != alice || got.MsgID != ack.MsgID || got.ClientMsgID == "" {
+		t.Fatalf("bob got %+v", got)
+	}
+	if copied != got || text != "hello" {
+		t.Fatalf("laptop got %+v %q, bob %+v", copied, text, got)
+	}
+
+	// without a session there is nobody to send as
+	anon := s.dial()
+	ack = anon.chat(bob, "who am i")
+	if ack.Status != message.AckRejected || ack.Code != message.CodeUnauthorized {
+		t.Fatalf("chat without login acked with %+v", ack)
+	}
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/byronzhu-haha/chat/entity/message"
+)
+
+var (
+	errSelfFriend      = errors.New("can not make friend with yourself")
+	errNoFriendRequest = errors.New("no such friend request")
+)
+
+// MakeFriend sends a friend request to friendID. If friendID already asked
+// userid, the two become friends right away. It returns the friends of
+// userid.
+func (s *ChatServer) MakeFriend(c message.Codec, userid, friendID string) (resp []byte, err error) {
+	if userid == friendID {
+		return resp, errSelfFriend
+	}
+	u, err := s.userRepo.Get(userid)
+	if err != nil {
+		return resp, err
+	}
+	f, err := s.userRepo.Get(friendID)
+	if err != nil {
+		return resp, err
+	}
+	if u.HasBlocked(friendID) {
+		return resp, errForbidden
+	}
+	if u.HasFriend(friendID) {
+		return s.listFriend(c, userid)
+	}
+	if u.HasRequestIn(friendID) {
+		return s.AcceptFriend(c, userid, friendID)
+	}
+	if !f.Admits(f.Privacy().FriendRequest, userid) {
+		return resp, errForbidden
+	}
+	err = s.userRepo.AddFriendRequest(userid, friendID)
+	if err != nil {
+		return resp, err
+	}
+	s.notifyFriend(friendID, message.FriendRequested, userid)
+	return s.listFriend(c, userid)
+}
+
+// AcceptFriend makes userid and the sender of the pending request from
+// friends.
+func (s *ChatServer) AcceptFriend(c message.Codec, userid, from string) (resp []byte, err error) {
+	ok, err := s.userRepo.DelFriendRequest(from, userid)
+	if err != nil {
+		return resp, err
+	}
+	if !ok {
+		return resp, errNoFriendRequest
+	}
+	err = s.userRepo.AddUserFriend(userid, from)
+	if err != nil {
+		return resp, err
+	}
+	s.notifyFriend(from, message.FriendAccepted, userid)
+	return s.listFriend(c, userid)
+}
+
+func (s *ChatServer) RejectFriend(userid, from string) (resp []byte, err error) {
+	ok, err := s.userRepo.DelFriendRequest(from, userid)
+	if err != nil {
+		return resp, err
+	}
+	if !ok {
+		return resp, errNoFriendRequest
+	}
+	s.notifyFriend(from, message.FriendRejected, userid)
+	return
+}
+
+func (s *ChatServer) CancelFriend(userid, to string) (resp []byte, err error) {
+	ok, err := s.userRepo.DelFriendRequest(userid, to)
+	if err != nil {
+		return resp, err
+	}
+	if !ok {
+		return resp, errNoFriendRequest
+	}
+	s.notifyFriend(to, message.FriendCanceled, userid)
+	return
+}
+
+func (s *ChatServer) ListFriendRequest(c message.Codec, userid string) (resp []byte, err error) {
+	var reqs message.FriendRequests
+	reqs.Incoming, reqs.Outgoing = s.userRepo.ListFriendRequest(userid)
+	return reqs.Marshal(c)
+}
+
+// notifyFriend tells to, if online, that userid caused event. Offline users
+// find pending requests with ListFriendRequest.
+func (s *ChatServer) notifyFriend(to string, event message.FriendEventType, userid string) {
+	if !s.online(to) {
+		return
+	}
+	e := message.FriendEvent{Event: event, UserID: userid}
+	if u, err := s.userRepo.Get(userid); err == nil {
+		e.Name = u.Name()
+	}
+	s.sendToUser(to, func(c message.Codec) ([]byte, error) {
+		body, err := message.PackFriendEvent(c, &e)
+		if err != nil {
+			return nil, err
+		}
+		return message.Pack(c, message.MsgTypeFriend, nil, body)
+	})
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/byronzhu-haha/chat/entity/group"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/entity/user"
+	"github.com/byronzhu-haha/chat/server/repo"
+)
+
+var errForbidden = errors.New("forbidden")
+
+func (s *ChatServer) CreateGroup(userid, name string, kind group.Kind) (resp []byte, err error) {
+	if name == "" {
+		return resp, errors.New("group name must not be empty")
+	}
+	if kind != group.Private && kind != group.Room {
+		return resp, errors.New("unknown group kind")
+	}
+	id := repo.GenerateOneID()
+	err = s.groupRepo.Create(group.NewGroup(id, name, kind, userid))
+	if err == nil {
+		resp = []byte(id)
+	}
+	return
+}
+
+// JoinGroup lets userid into a room; private groups can only be joined by
+// invitation.
+func (s *ChatServer) JoinGroup(userid, groupID string) (resp []byte, err error) {
+	g, err := s.groupRepo.Get(groupID)
+	if err != nil {
+		return resp, err
+	}
+	if g.Kind != group.Room {
+		return resp, errForbidden
+	}
+	err = s.groupRepo.AddMember(groupID, userid)
+	return
+}
+
+func (s *ChatServer) LeaveGroup(userid, groupID string) (resp []byte, err error) {
+	err = s.checkMember(userid, groupID)
+	if err != nil {
+		return resp, err
+	}
+	err = s.groupRepo.DelMember(groupID, userid)
+	return
+}
+
+// InviteGroup adds destUserID to the group; any member may invite.
+func (s *ChatServer) InviteGroup(userid, groupID, destUserID string) (resp []byte, err error) {
+	err = s.checkMember(userid, groupID)
+	if err != nil {
+		return resp, err
+	}
+	dest, err := s.userRepo.Get(destUserID)
+	if err != nil {
+		return resp, err
+	}
+	if dest.HasBlocked(userid) {
+		return resp, errForbidden
+	}
+	err = s.groupRepo.AddMember(groupID, destUserID)
+	return
+}
+
+func (s *ChatServer) ListGroupMember(c message.Codec, userid, groupID string) (resp []byte, err error) {
+	err = s.checkMember(userid, groupID)
+	if err != nil {
+		return resp, err
+	}
+	ids, err := s.groupRepo.Members(groupID)
+	if err != nil {
+		return resp, err
+	}
+	var members = make(message.UserList, 0, len(ids))
+	for _, id := range ids {
+		u, err := s.userRepo.Get(id)
+		if err != nil {
+			members = append(members, user.BriefUser{ID: id})
+			continue
+		}
+		members = append(members, u.BriefFor(userid))
+	}
+	return members.Marshal(c)
+}
+
+func (s *ChatServer) checkMember(userid, groupID string) error {
+	ok, err := s.groupRepo.IsMember(groupID, userid)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errForbidden
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/byronzhu-haha/log"
+	"net"
+	"net/http"
+)
+
+// serveMetrics serves the send queue stats of the connections as json at
+// /debug/queues on the MetricsAddr of the config, until Shutdown.
+func (s *ChatServer) serveMetrics() error {
+	listener, err := net.Listen("tcp", s.cfg.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/queues", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(s.connManager.QueueStats())
+		if err != nil {
+			log.Warnf("write queue stats to %s failed, err: %+v", r.RemoteAddr, err)
+		}
+	})
+	s.metrics = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: s.cfg.ReadDeadline(),
+		WriteTimeout:      s.cfg.WriteDeadline(),
+	}
+	go func() {
+		err := s.metrics.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("serve metrics on %s failed, err: %+v", s.cfg.MetricsAddr, err)
+		}
+	}()
+	log.Infof("serve metrics on %s", listener.Addr())
+	return nil
+}
@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/entity/user"
+	"github.com/byronzhu-haha/chat/server/conn"
+	"github.com/byronzhu-haha/log"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// presenceHub keeps who subscribed to the presence of whom. Subscriptions
+// belong to the subscriber while logged in and end with their last session.
+type presenceHub struct {
+	mu    sync.Mutex
+	subs  map[string]map[string]struct{}
+	bySub map[string]map[string]struct{}
+}
+
+func newPresenceHub() *presenceHub {
+	return &presenceHub{
+		subs:  make(map[string]map[string]struct{}),
+		bySub: make(map[string]map[string]struct{}),
+	}
+}
+
+func (h *presenceHub) subscribe(sub, target string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	add(h.subs, target, sub)
+	add(h.bySub, sub, target)
+}
+
+func (h *presenceHub) unsubscribe(sub, target string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	del(h.subs, target, sub)
+	del(h.bySub, sub, target)
+}
+
+// drop ends every subscription of sub.
+func (h *presenceHub) drop(sub string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for target := range h.bySub[sub] {
+		del(h.subs, target, sub)
+	}
+	delete(h.bySub, sub)
+}
+
+func (h *presenceHub) subscribers(target string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := make([]string, 0, len(h.subs[target]))
+	for sub := range h.subs[target] {
+		res = append(res, sub)
+	}
+	return res
+}
+
+func add(m map[string]map[string]struct{}, k, v string) {
+	set, ok := m[k]
+	if !ok {
+		set = make(map[string]struct{})
+		m[k] = set
+	}
+	set[v] = struct{}{}
+}
+
+func del(m map[string]map[string]struct{}, k, v string) {
+	delete(m[k], v)
+	if len(m[k]) == 0 {
+		delete(m, k)
+	}
+}
+
+// setState changes the state of u, see changePresence.
+func (s *ChatServer) setState(u *user.User, state user.State) {
+	s.changePresence(u, func() {
+		u.SetState(state)
+	})
+}
+
+// changePresence applies change to u and pushes the new presence to the
+// online users who have u as a friend or subscribed to u and see u
+// differently since. Going offline is saved so that the last seen time
+// survives restarts.
+func (s *ChatServer) changePresence(u *user.User, change func()) {
+	watchers := s.watchers(u.ID())
+	before := make([]user.BriefUser, len(watchers))
+	for i, to := range watchers {
+		before[i] = u.BriefFor(to)
+	}
+	change()
+	if u.State() == user.Offline {
+		delete(s.autoAway, u.ID())
+		err := s.userRepo.Save(u)
+		if err != nil {
+			log.Errorf("save last seen of user(%s) failed, err: %+v", u.ID(), err)
+		}
+	}
+	for i, to := range watchers {
+		after := u.BriefFor(to)
+		if after == before[i] {
+			continue
+		}
+		s.sendToUser(to, presencePacker(message.PresenceOf(after)))
+	}
+}
+
+func (s *ChatServer) watchers(userid string) []string {
+	seen := make(map[string]struct{})
+	var res []string
+	for _, ids := range [][]string{s.userRepo.ListUserFollower(userid), s.presence.subscribers(userid)} {
+		for _, id := range ids {
+			if _, ok := seen[id]; ok || id == userid {
+				continue
+			}
+			seen[id] = struct{}{}
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// onDisconnect takes the user of a dropped connection offline, unless they
+// are logged in on another connection by now.
+func (s *ChatServer) onDisconnect(addr, userid string) {
+	if userid == "" {
+		return
+	}
+	if s.online(userid) {
+		return
+	}
+	s.presence.drop(userid)
+	u, err := s.userRepo.Get(userid)
+	if err != nil {
+		log.Warnf("user(%s) of closed conn(%s) is gone, err: %+v", userid, addr, err)
+		return
+	}
+	s.setState(u, user.Offline)
+}
+
+func (s *ChatServer) SubscribePresence(c message.Codec, userid, target string) (resp []byte, err error) {
+	u, err := s.userRepo.Get(target)
+	if err != nil {
+		return resp, err
+	}
+	s.presence.subscribe(userid, target)
+	p := message.PresenceOf(u.BriefFor(userid))
+	return message.PackPresence(c, &p)
+}
+
+func (s *ChatServer) UnsubscribePresence(userid, target string) (resp []byte, err error) {
+	s.presence.unsubscribe(userid, target)
+	return
+}
+
+const maxStatusText = 140
+
+// SetPresence sets the state and the status text userid is shown with; going
+// offline takes a logout.
+func (s *ChatServer) SetPresence(userid string, state user.State, text string) (resp []byte, err error) {
+	switch state {
+	case user.Online, user.Away, user.Busy, user.DoNotDisturb, user.Invisible:
+	default:
+		return resp, fmt.Errorf("can not set state %s", state)
+	}
+	if utf8.RuneCountInString(text) > maxStatusText {
+		return resp, fmt.Errorf("status text is longer than %d characters", maxStatusText)
+	}
+	u, err := s.userRepo.Get(userid)
+	if err != nil {
+		return resp, err
+	}
+	delete(s.autoAway, userid)
+	s.changePresence(u, func() {
+		u.SetState(state)
+		u.SetStatusText(text)
+	})
+	return resp, s.userRepo.Save(u)
+}
+
+// checkIdle shows online users whose connections have all been idle for
+// longer than the IdleAway of the config as away, until they are active
+// again.
+func (s *ChatServer) checkIdle() {
+	after := s.cfg.IdleAwayAfter()
+	least := make(map[string]time.Duration)
+	for addr, userid := range s.connManager.Sessions() {
+		idle, ok := s.connManager.Idle(addr)
+		if !ok {
+			continue
+		}
+		if d, seen := least[userid]; !seen || idle < d {
+			least[userid] = idle
+		}
+	}
+	for userid, idle := range least {
+		if idle < after {
+			continue
+		}
+		u, err := s.userRepo.Get(userid)
+		if err != nil || u.State() != user.Online {
+			continue
+		}
+		s.autoAway[userid] = true
+		s.setState(u, user.Away)
+	}
+}
+
+// touch brings the user logged in at addr back from being away while idle.
+func (s *ChatServer) touch(addr string) {
+	userid, _, ok := s.connManager.Session(addr)
+	if !ok || !s.autoAway[userid] {
+		return
+	}
+	delete(s.autoAway, userid)
+	u, err := s.userRepo.Get(userid)
+	if err != nil {
+		return
+	}
+	s.setState(u, user.Online)
+}
+
+func presencePacker(p message.Presence) conn.Packer {
+	return func(c message.Codec) ([]byte, error) {
+		body, err := message.PackPresence(c, &p)
+		if err != nil {
+			return nil, err
+		}
+		return message.Pack(c, message.MsgTypePresence, nil, body)
+	}
+}
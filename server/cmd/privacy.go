@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/entity/user"
+)
+
+var errSelfBlock = errors.New("can not block yourself")
+
+// Block stops target from messaging userid, sending them friend requests,
+// inviting them to groups and finding them or seeing their presence. It ends
+// the friendship between the two.
+func (s *ChatServer) Block(userid, target string) (resp []byte, err error) {
+	if userid == target {
+		return resp, errSelfBlock
+	}
+	u, err := s.userRepo.Get(userid)
+	if err != nil {
+		return resp, err
+	}
+	s.changePresence(u, func() {
+		err = s.userRepo.Block(userid, target)
+	})
+	return
+}
+
+func (s *ChatServer) Unblock(userid, target string) (resp []byte, err error) {
+	u, err := s.userRepo.Get(userid)
+	if err != nil {
+		return resp, err
+	}
+	s.changePresence(u, func() {
+		err = s.userRepo.Unblock(userid, target)
+	})
+	return
+}
+
+func (s *ChatServer) ListBlocked(c message.Codec, userid string) (resp []byte, err error) {
+	u, err := s.userRepo.Get(userid)
+	if err != nil {
+		return resp, err
+	}
+	ids := u.ListBlocked()
+	var users = make(message.UserList, 0, len(ids))
+	for _, id := range ids {
+		b, err := s.userRepo.Get(id)
+		if err != nil {
+			users = append(users, user.BriefUser{ID: id})
+			continue
+		}
+		users = append(users, b.BriefFor(userid))
+	}
+	return users.Marshal(c)
+}
+
+// SetPrivacy replaces the privacy setting of userid. Friend requests come
+// from users who are not friends yet, so they are either open to everyone or
+// to nobody.
+func (s *ChatServer) SetPrivacy(userid string, p user.Privacy) (resp []byte, err error) {
+	for _, a := range []user.Audience{p.Search, p.FriendRequest, p.Presence} {
+		if a > user.Nobody {
+			return resp, fmt.Errorf("unknown audience %d", a)
+		}
+	}
+	if p.FriendRequest == user.Friends {
+		return resp, fmt.Errorf("friend requests can not be limited to %s", user.Friends)
+	}
+	u, err := s.userRepo.Get(userid)
+	if err != nil {
+		return resp, err
+	}
+	s.changePresence(u, func() {
+		u.SetPrivacy(p)
+	})
+	return resp, s.userRepo.Save(u)
+}
+
+func (s *ChatServer) GetPrivacy(c message.Codec, userid string) (resp []byte, err error) {
+	u, err := s.userRepo.Get(userid)
+	if err != nil {
+		return resp, err
+	}
+	p := u.Privacy()
+	return message.PackPrivacy(c, &p)
+}
@@ -2,31 +2,124 @@ package cmd
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"github.com/byronzhu-haha/chat/entity/message"
 	"github.com/byronzhu-haha/chat/entity/user"
+	"github.com/byronzhu-haha/chat/server/auth"
+	"github.com/byronzhu-haha/chat/server/config"
 	"github.com/byronzhu-haha/chat/server/conn"
 	"github.com/byronzhu-haha/chat/server/repo"
 	"github.com/byronzhu-haha/log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type ChatServer struct {
 	init        bool
+	cfg         *config.Config
 	connManager *conn.Manager
 	userRepo    repo.Repo
-	messages    chan message.Message
+	groupRepo   repo.GroupRepo
+	hasher      *auth.Hasher
+	pwdPolicy   auth.PasswordPolicy
+	tokens      *auth.TokenIssuer
+	inbox       repo.Inbox
+	history     repo.History
+	presence    *presenceHub
+	// users shown as away because they were idle, owned by HandleMessage
+	autoAway    map[string]bool
+	messages    chan conn.Request
+	disconnects chan disconnect
+	// handled is closed when HandleMessage returns, closed when Shutdown is
+	// done
+	handled  chan struct{}
+	closed   chan struct{}
+	shutdown sync.Once
+	cancel   context.CancelFunc
+	metrics  *http.Server
 }
 
-func NewChatServer() *ChatServer {
-	return &ChatServer{
+type disconnect struct {
+	addr   string
+	userid string
+}
+
+func NewChatServer(cfg *config.Config) (*ChatServer, error) {
+	userRepo, err := repo.NewRepo(cfg)
+	if err != nil {
+		return nil, err
+	}
+	secret := cfg.SessionSecret
+	if secret == "" && cfg.Storage == repo.StorageFile {
+		// keep the sessions valid across restarts along with the users
+		secret, err = auth.LoadSecret(filepath.Join(cfg.DataDir, "session.key"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	tokens, err := auth.NewTokenIssuer(secret, cfg.SessionLifetime(), userRepo)
+	if err != nil {
+		return nil, err
+	}
+	groupRepo, err := repo.NewGroupRepo(cfg)
+	if err != nil {
+		return nil, err
+	}
+	inbox, err := repo.NewInbox(cfg)
+	if err != nil {
+		return nil, err
+	}
+	history, err := repo.NewHistory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &ChatServer{
 		init:        true,
-		connManager: conn.NewManager(),
-		userRepo:    repo.NewUserManager(),
-		messages:    make(chan message.Message, 1000),
+		cfg:         cfg,
+		connManager: conn.NewManager(cfg),
+		userRepo:    userRepo,
+		groupRepo:   groupRepo,
+		hasher: auth.NewHasher(auth.HashParams{
+			Memory:  uint32(cfg.HashMemory),
+			Time:    uint32(cfg.HashTime),
+			Threads: uint8(cfg.HashThreads),
+			SaltLen: 16,
+			KeyLen:  32,
+		}),
+		pwdPolicy: auth.PasswordPolicy{
+			MinLength:     cfg.PasswordMinLength,
+			MaxLength:     cfg.PasswordMaxLength,
+			RequireLetter: cfg.PasswordRequireLetter,
+			RequireDigit:  cfg.PasswordRequireDigit,
+			RequireSymbol: cfg.PasswordRequireSymbol,
+		},
+		tokens:      tokens,
+		inbox:       inbox,
+		history:     history,
+		presence:    newPresenceHub(),
+		autoAway:    make(map[string]bool),
+		messages:    make(chan conn.Request, cfg.ChanSize),
+		disconnects: make(chan disconnect, cfg.ChanSize),
+		handled:     make(chan struct{}),
+		closed:      make(chan struct{}),
 	}
+	s.connManager.OnDisconnect(func(addr, userid string) {
+		select {
+		case s.disconnects <- disconnect{addr: addr, userid: userid}:
+		case <-s.handled:
+		}
+	})
+	return s, nil
 }
 
+// Run serves until the process gets SIGINT or SIGTERM, or until Shutdown is
+// called, and shuts the server down gracefully.
 func (s *ChatServer) Run() {
 	if !s.init {
 		log.Errorf("server is not init")
@@ -36,107 +129,470 @@ func (s *ChatServer) Run() {
 	if err != nil {
 		panic(err.Error())
 	}
-	done := make(chan struct{})
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
+	if s.cfg.MetricsAddr != "" {
+		err = s.serveMetrics()
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
 	go s.connManager.HandleMetadata(ctx, s.messages)
 	go s.HandleMessage()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
 	select {
-	case <-done:
-		cancel()
+	case sig := <-signals:
+		log.Infof("got signal %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownDeadline())
+		defer cancel()
+		err = s.Shutdown(ctx)
+		if err != nil {
+			log.Errorf("shutdown failed, err: %+v", err)
+		}
+	case <-s.closed:
 	}
 }
 
-func (s *ChatServer) HandleMessage() {
-	for m := range s.messages {
-		head, _ := message.UnpackRequestHeader(m.Head)
-		meta, err := message.UnpackMetadata(m.Body)
-		if err != nil {
-			log.Errorf("unpack meta failed, err: %v", err)
-			continue
+// Shutdown stops accepting connections, tells every client the server goes
+// away and stops reading from them. The messages read before are handled and
+// the answers written until ctx is done, when the messages still waiting to
+// be passed on to the handler are dropped. Once the handler has stopped, the
+// users still online are set offline, the connections closed and the storage
+// flushed.
+func (s *ChatServer) Shutdown(ctx context.Context) (err error) {
+	s.shutdown.Do(func() {
+		defer close(s.closed)
+		s.connManager.Drain(func(c message.Codec) ([]byte, error) {
+			return message.PackGoAway(c)
+		})
+		if s.cancel != nil {
+			select {
+			case <-s.handled:
+			case <-ctx.Done():
+				log.Warnf("shutdown deadline passed before all messages were handled")
+				err = ctx.Err()
+			}
+			s.cancel()
+			<-s.handled
+		}
+		s.logoutAll()
+		if e := s.connManager.Close(ctx); e != nil && err == nil {
+			err = e
+		}
+		if s.metrics != nil {
+			_ = s.metrics.Close()
 		}
+		if e := s.closeStorage(); e != nil && err == nil {
+			err = e
+		}
+	})
+	return
+}
+
+// logoutAll sets the users still online offline, it must not run along with
+// HandleMessage. The sessions are kept, so clients can resume them after a
+// restart if the secret of the tokens outlives it, see SessionSecret.
+func (s *ChatServer) logoutAll() {
+	for addr, userid := range s.connManager.Sessions() {
+		s.connManager.Unbind(addr)
+		s.onDisconnect(addr, userid)
+	}
+}
+
+func (s *ChatServer) closeStorage() (err error) {
+	stores := []struct {
+		name string
+		c    interface{ Close() error }
+	}{
+		{"user repo", s.userRepo},
+		{"group repo", s.groupRepo},
+		{"inbox", s.inbox},
+		{"history", s.history},
+	}
+	for _, store := range stores {
+		if e := store.c.Close(); e != nil {
+			log.Errorf("close %s failed, err: %+v", store.name, e)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return
+}
 
-		var (
-			resp []byte
-			code = message.CodeOk
-		)
-		switch meta.Operate {
-		case message.OperateTypeRegister:
-			resp, err = s.Register(meta.Username, meta.Passwd)
-		case message.OperateTypeLogin:
-			resp, err = s.Login(head.SrcAddr, meta.Username, meta.Passwd)
-		case message.OperateTypeLogout:
-			resp, err = s.Logout(meta.Username)
-		case message.OperateTypeDelete:
-			resp, err = s.Delete(meta.Username)
-		case message.OperateTypeSearchFriend:
-			resp, err = s.SearchFriend(meta.Username, meta.Userid)
-		case message.OperateTypeMakeFriend:
-			resp, err = s.MakeFriend(meta.Userid, meta.DestUserID)
-		case message.OperateTypeDeleteFriend:
-			resp, err = s.DeleteFriend(meta.Userid, meta.DestUserID)
-		case message.OperateTypeListFriend:
-			resp, err = s.ListFriend(meta.Userid)
-		default:
-			log.Infof("invalid operate, srcAddr: %s", head.SrcAddr)
-			code = message.CodeInvalidOperate
+func (s *ChatServer) HandleMessage() {
+	defer close(s.handled)
+	var idle <-chan time.Time
+	if after := s.cfg.IdleAwayAfter(); after > 0 {
+		ticker := time.NewTicker(idleCheckInterval(after))
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+	for {
+		select {
+		case r, ok := <-s.messages:
+			if !ok {
+				return
+			}
+			s.touch(r.Addr)
+			switch {
+			case r.Msg.IsRequestMsg():
+				s.handleRequest(r)
+			case r.Msg.IsChatMsg():
+				s.transferChat(r)
+			case r.Msg.IsAckMsg(), r.Msg.IsReceiptMsg():
+				s.transferAck(r)
+			}
+		case d := <-s.disconnects:
+			s.onDisconnect(d.addr, d.userid)
+		case <-idle:
+			s.checkIdle()
 		}
+	}
+}
+
+func idleCheckInterval(after time.Duration) time.Duration {
+	if d := after / 4; d > time.Second {
+		return d
+	}
+	return time.Second
+}
+
+func (s *ChatServer) handleRequest(r conn.Request) {
+	head, err := message.UnpackRequestHeader(r.Codec, r.Msg.Head)
+	if err != nil {
+		log.Errorf("unpack request header failed, err: %v", err)
+		return
+	}
+	meta, err := message.UnpackMetadata(r.Codec, r.Msg.Body)
+	if err != nil {
+		log.Errorf("unpack meta failed, err: %v", err)
+		return
+	}
+
+	var code = message.CodeOk
+	resp, err := s.handle(r, meta)
+	if err != nil {
+		log.Errorf("handle %s from %s failed, err: %+v", meta.Operate, r.Addr, err)
+		code = codeOf(err)
+	}
+	packs := []conn.Packer{func(c message.Codec) ([]byte, error) {
+		respHead, err := message.PackResponseHeader(c, r.Addr, meta.Operate, head.Seq, code)
 		if err != nil {
-			log.Errorf("pack resp message failed, err: %+v", err)
-			code = message.CodeFailed
+			return nil, err
+		}
+		return message.Pack(c, message.MsgTypeResp, respHead, resp)
+	}}
+	if !opensSession(meta.Operate) || code != message.CodeOk {
+		_ = s.connManager.SendMsgs(r.Addr, packs...)
+		return
+	}
+
+	// the offline messages follow the login response on the same connection
+	uid, _, _ := s.connManager.Session(r.Addr)
+	msgs, err := s.inbox.Drain(uid)
+	if err != nil {
+		log.Errorf("drain inbox of user(%s) failed, err: %+v", uid, err)
+	}
+	for _, msg := range msgs {
+		packs = append(packs, chatPacker(msg))
+	}
+	// the batch may not fit the send queue, keep what was not queued
+	n, err := s.connManager.SendBacklog(r.Addr, packs...)
+	if err != nil {
+		if n > 0 {
+			n--
 		}
-		respHead, _ := message.PackResponseHeader(head.SrcAddr, meta.Operate, 0, code)
-		msg, _ := message.Pack(message.MsgTypeResp, respHead, resp)
-		s.connManager.SendMsg(head.SrcAddr, msg)
+		s.keepOffline(msgs[n:])
+	}
+}
+
+func opensSession(op message.OperateType) bool {
+	return op == message.OperateTypeLogin || op == message.OperateTypeResume
+}
+
+func (s *ChatServer) handle(r conn.Request, meta message.ServerMetadata) (resp []byte, err error) {
+	switch meta.Operate {
+	case message.OperateTypeRegister:
+		return s.Register(meta.Username, meta.Passwd)
+	case message.OperateTypeLogin:
+		return s.Login(r.Codec, r.Addr, meta.Username, meta.Passwd, deviceOf(meta))
+	case message.OperateTypeResume:
+		return s.Resume(r.Codec, r.Addr, meta.Token, deviceOf(meta))
+	}
+
+	// every other operation acts on behalf of the user logged in on this
+	// connection, whatever user id the client put into the metadata
+	uid, err := s.authorize(r.Addr, meta.Token)
+	if err != nil {
+		return resp, err
+	}
+	switch meta.Operate {
+	case message.OperateTypeLogout:
+		return s.Logout(r.Addr, uid)
+	case message.OperateTypeDelete:
+		return s.Delete(r.Addr, uid)
+	case message.OperateTypeSearchFriend:
+		return s.SearchFriend(r.Codec, uid, meta.Username, meta.Userid)
+	case message.OperateTypeMakeFriend:
+		return s.MakeFriend(r.Codec, uid, meta.DestUserID)
+	case message.OperateTypeDeleteFriend:
+		return s.DeleteFriend(r.Codec, uid, meta.DestUserID)
+	case message.OperateTypeListFriend:
+		return s.ListFriend(r.Codec, uid)
+	case message.OperateTypeCreateGroup:
+		return s.CreateGroup(uid, meta.GroupName, meta.GroupKind)
+	case message.OperateTypeJoinGroup:
+		return s.JoinGroup(uid, meta.GroupID)
+	case message.OperateTypeLeaveGroup:
+		return s.LeaveGroup(uid, meta.GroupID)
+	case message.OperateTypeInviteGroup:
+		return s.InviteGroup(uid, meta.GroupID, meta.DestUserID)
+	case message.OperateTypeListGroupMember:
+		return s.ListGroupMember(r.Codec, uid, meta.GroupID)
+	case message.OperateTypeHistory:
+		return s.History(r.Codec, uid, meta)
+	case message.OperateTypeSubscribePresence:
+		return s.SubscribePresence(r.Codec, uid, meta.DestUserID)
+	case message.OperateTypeUnsubscribePresence:
+		return s.UnsubscribePresence(uid, meta.DestUserID)
+	case message.OperateTypeSetPresence:
+		return s.SetPresence(uid, meta.State, meta.StatusText)
+	case message.OperateTypeAcceptFriend:
+		return s.AcceptFriend(r.Codec, uid, meta.DestUserID)
+	case message.OperateTypeRejectFriend:
+		return s.RejectFriend(uid, meta.DestUserID)
+	case message.OperateTypeCancelFriend:
+		return s.CancelFriend(uid, meta.DestUserID)
+	case message.OperateTypeListFriendRequest:
+		return s.ListFriendRequest(r.Codec, uid)
+	case message.OperateTypeBlock:
+		return s.Block(uid, meta.DestUserID)
+	case message.OperateTypeUnblock:
+		return s.Unblock(uid, meta.DestUserID)
+	case message.OperateTypeListBlocked:
+		return s.ListBlocked(r.Codec, uid)
+	case message.OperateTypeSetPrivacy:
+		return s.SetPrivacy(uid, meta.Privacy)
+	case message.OperateTypeGetPrivacy:
+		return s.GetPrivacy(r.Codec, uid)
+	case message.OperateTypeListSessions:
+		return s.ListSessions(r.Codec, r.Addr, uid)
+	case message.OperateTypeRevokeSession:
+		return s.RevokeSession(r.Addr, uid, meta.DeviceID)
+	}
+	return resp, errInvalidOperate
+}
+
+// authorize checks that token is valid and is the session bound to the
+// connection at addr, and returns the user it belongs to.
+func (s *ChatServer) authorize(addr, token string) (string, error) {
+	uid, err := s.tokens.Verify(token)
+	if err != nil {
+		return "", err
+	}
+	bound, boundToken, ok := s.connManager.Session(addr)
+	if !ok || bound != uid || subtle.ConstantTimeCompare([]byte(boundToken), []byte(token)) != 1 {
+		return "", auth.ErrUnauthorized
 	}
+	return uid, nil
+}
+
+var errInvalidOperate = errors.New("invalid operate")
+
+func codeOf(err error) message.Code {
+	switch {
+	case errors.Is(err, errInvalidOperate):
+		return message.CodeInvalidOperate
+	case errors.Is(err, auth.ErrWeakPassword):
+		return message.CodeWeakPassword
+	case errors.Is(err, auth.ErrUnauthorized), errors.Is(err, auth.ErrTokenExpired):
+		return message.CodeUnauthorized
+	case errors.Is(err, errForbidden):
+		return message.CodeForbidden
+	}
+	return message.CodeFailed
 }
 
 func (s *ChatServer) Register(name, pwd string) (resp []byte, err error) {
+	err = s.pwdPolicy.Validate(pwd)
+	if err != nil {
+		return resp, err
+	}
+	hash, err := s.hasher.Hash(pwd)
+	if err != nil {
+		return resp, err
+	}
 	id := repo.GenerateOneID()
-	err = s.userRepo.Save(user.NewUser(id, name, pwd, user.Offline))
+	err = s.userRepo.Save(user.NewUser(id, name, hash, user.Offline))
 	if err == nil {
 		resp = []byte(id)
 	}
 	return
 }
 
-func (s *ChatServer) Login(addr string, userid, pwd string) (resp []byte, err error) {
+func (s *ChatServer) Login(c message.Codec, addr string, userid, pwd string, device conn.Device) (resp []byte, err error) {
 	u, err := s.userRepo.Get(userid)
+	if errors.Is(err, repo.ErrNotFoundUser) {
+		// as slow and as failed as a wrong password
+		s.hasher.VerifyDummy(pwd)
+		return resp, auth.ErrInvalidPassword
+	}
 	if err != nil {
 		return resp, err
 	}
-	if pwd != u.Pwd() {
-		err = errors.New("passwd error")
+	ok, rehash, err := s.hasher.Verify(u.Pwd(), pwd)
+	if err != nil {
 		return resp, err
 	}
-	err = repo.SetUserIP(userid, addr)
+	if !ok {
+		return resp, auth.ErrInvalidPassword
+	}
+	if rehash {
+		s.rehash(u, pwd)
+	}
+	return s.openSession(c, addr, u, device)
+}
+
+// Resume logs the user of token in again on a new connection at addr, after
+// the client lost the connection the token was issued on. The token is
+// traded for a new one, so it resumes a session once only.
+func (s *ChatServer) Resume(c message.Codec, addr, token string, device conn.Device) (resp []byte, err error) {
+	userid, err := s.tokens.Verify(token)
 	if err != nil {
 		return resp, err
 	}
-	u.SetState(user.Online)
-	return
+	u, err := s.userRepo.Get(userid)
+	if err != nil {
+		return resp, err
+	}
+	resp, err = s.openSession(c, addr, u, device)
+	if err != nil {
+		return resp, err
+	}
+	s.revoke(token)
+	return resp, nil
+}
+
+// openSession binds a new session of u on device to the connection at addr
+// and answers with its token. The other sessions of u stay open, except one
+// left behind on the same device, which is replaced.
+func (s *ChatServer) openSession(c message.Codec, addr string, u *user.User, device conn.Device) (resp []byte, err error) {
+	if device.ID == "" {
+		device.ID, err = newDeviceID()
+		if err != nil {
+			return resp, err
+		}
+	}
+	// a connection carries one session, the one it has ends first so that
+	// its token is revoked and its user goes offline if it was their last
+	if prev, _, ok := s.connManager.Session(addr); ok {
+		s.closeSession(addr)
+		if prev != u.ID() && !s.online(prev) {
+			if pu, err := s.userRepo.Get(prev); err == nil {
+				s.setState(pu, user.Offline)
+				s.presence.drop(prev)
+			}
+		}
+	}
+	token, err := s.tokens.Issue(u.ID())
+	if err != nil {
+		return resp, err
+	}
+	err = s.connManager.Bind(addr, u.ID(), token, device)
+	if err != nil {
+		return resp, err
+	}
+	for _, sess := range s.connManager.UserSessions(u.ID()) {
+		if sess.Addr != addr && sess.Device.ID == device.ID {
+			s.dropSession(sess)
+		}
+	}
+	if u.State() == user.Offline {
+		s.setState(u, user.Online)
+	}
+	return message.PackLoginResult(c, token, device.ID)
+}
+
+// rehash upgrades the stored hash of u to the current parameters. A failure
+// only means the old hash is kept, so it does not fail the login.
+func (s *ChatServer) rehash(u *user.User, pwd string) {
+	hash, err := s.hasher.Hash(pwd)
+	if err != nil {
+		log.Errorf("rehash password of user(%s) failed, err: %+v", u.ID(), err)
+		return
+	}
+	u.SetPwd(hash)
+	err = s.userRepo.Save(u)
+	if err != nil {
+		log.Errorf("save rehashed password of user(%s) failed, err: %+v", u.ID(), err)
+	}
 }
 
-func (s *ChatServer) Logout(userid string) (resp []byte, err error) {
+// Logout ends the session at addr; the user goes offline with their last
+// session.
+func (s *ChatServer) Logout(addr, userid string) (resp []byte, err error) {
 	u, err := s.userRepo.Get(userid)
 	if err != nil {
 		return resp, err
 	}
-	u.SetState(user.Offline)
+	s.closeSession(addr)
+	if s.online(userid) {
+		return
+	}
+	s.setState(u, user.Offline)
+	s.presence.drop(userid)
 	return
 }
 
-func (s *ChatServer) Delete(userid string) (resp []byte, err error) {
+// closeSession unbinds the session at addr and revokes its token, so that it
+// can not be resumed.
+func (s *ChatServer) closeSession(addr string) {
+	if _, token, ok := s.connManager.Session(addr); ok {
+		s.revoke(token)
+	}
+	s.connManager.Unbind(addr)
+}
+
+func (s *ChatServer) Delete(addr, userid string) (resp []byte, err error) {
+	u, err := s.userRepo.Get(userid)
+	if err != nil {
+		return resp, err
+	}
+	s.setState(u, user.Offline)
+	s.presence.drop(userid)
 	err = s.userRepo.Del(userid)
+	if err != nil {
+		return resp, err
+	}
+	err = s.groupRepo.DelUser(userid)
+	if err != nil {
+		log.Errorf("drop groups of deleted user(%s) failed, err: %+v", userid, err)
+	}
+	_, err = s.inbox.Drain(userid)
+	if err != nil {
+		log.Errorf("drop inbox of deleted user(%s) failed, err: %+v", userid, err)
+	}
+	for _, sess := range s.connManager.UserSessions(userid) {
+		if sess.Addr != addr {
+			s.dropSession(sess)
+		}
+	}
+	s.closeSession(addr)
 	return
 }
 
-func (s *ChatServer) SearchFriend(username, userid string) (resp []byte, err error) {
+// SearchFriend finds the users viewer may find by id or by name, leaving out
+// those whose Search privacy does not admit viewer.
+func (s *ChatServer) SearchFriend(c message.Codec, viewer, username, userid string) (resp []byte, err error) {
 	var users = &message.UserList{}
 	u, err := s.userRepo.Get(userid)
-	if err == nil {
-		*users = append(*users, u)
-		return users.Marshal()
+	if err == nil && u.Admits(u.Privacy().Search, viewer) {
+		*users = append(*users, u.BriefFor(viewer))
+		return users.Marshal(c)
 	}
 	if username == "" {
 		return resp, repo.ErrNotFoundUser
@@ -146,42 +602,28 @@ func (s *ChatServer) SearchFriend(username, userid string) (resp []byte, err err
 		return resp, err
 	}
 	for i := 0; i < len(us); i++ {
-		*users = append(*users, us[i])
-	}
-	return users.Marshal()
-}
-
-func (s *ChatServer) MakeFriend(userid, friendID string) (resp []byte, err error) {
-	err = s.userRepo.AddUserFriend(userid, friendID)
-	if err != nil {
-		return resp, err
+		if !us[i].Admits(us[i].Privacy().Search, viewer) {
+			continue
+		}
+		*users = append(*users, us[i].BriefFor(viewer))
 	}
-
-	return s.listFriend(userid)
+	return users.Marshal(c)
 }
 
-func (s *ChatServer) DeleteFriend(userid, friendID string) (resp []byte, err error) {
+func (s *ChatServer) DeleteFriend(c message.Codec, userid, friendID string) (resp []byte, err error) {
 	err = s.userRepo.DelUserFriend(userid, friendID)
 	if err != nil {
 		return resp, err
 	}
 
-	return s.listFriend(userid)
+	return s.listFriend(c, userid)
 }
 
-func (s *ChatServer) ListFriend(userid string) (resp []byte, err error) {
-	return s.listFriend(userid)
+func (s *ChatServer) ListFriend(c message.Codec, userid string) (resp []byte, err error) {
+	return s.listFriend(c, userid)
 }
 
-func (s *ChatServer) listFriend(userid string) (resp []byte, err error) {
-	var (
-		us = s.userRepo.ListUserFriend(userid)
-		fs = &message.UserList{}
-	)
-
-	for _, u := range us {
-		*fs = append(*fs, user.NewUser(u.ID, u.Name, "", u.State))
-	}
-
-	return fs.Marshal()
-}
\ No newline at end of file
+func (s *ChatServer) listFriend(c message.Codec, userid string) (resp []byte, err error) {
+	var fs = message.UserList(s.userRepo.ListUserFriend(userid))
+	return fs.Marshal(c)
+}
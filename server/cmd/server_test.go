@@ -0,0 +1,345 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/server/config"
+	"github.com/byronzhu-haha/chat/server/conn"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPwd = "Passw0rd!"
+
+// testServer is a ChatServer whose messages the test hands to the handler
+// one at a time, in place of HandleMessage.
+type testServer struct {
+	*ChatServer
+	t *testing.T
+	// handling tracks the message being handled, the next one waits for it
+	// as it would in HandleMessage
+	handling sync.WaitGroup
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.ListenAddr = l.Addr().String()
+	_ = l.Close()
+	cfg.HashMemory, cfg.HashTime = 64, 1
+	cfg.WriteTimeout = 5
+
+	cs, err := NewChatServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cs.connManager.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go cs.connManager.HandleMetadata(ctx, cs.messages)
+	s := &testServer{ChatServer: cs, t: t}
+	t.Cleanup(func() {
+		s.handling.Wait()
+		cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	return s
+}
+
+// handleNext hands the next message read from any connection to the handler,
+// which runs in the background so that the test can read what it sends.
+func (s *testServer) handleNext() conn.Request {
+	s.t.Helper()
+	s.handling.Wait()
+	var r conn.Request
+	select {
+	case r = <-s.messages:
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("no message reached the handler")
+	}
+	s.handling.Add(1)
+	go func() {
+		defer s.handling.Done()
+		switch {
+		case r.Msg.IsRequestMsg():
+			s.handleRequest(r)
+		case r.Msg.IsChatMsg():
+			s.transferChat(r)
+		case r.Msg.IsAckMsg(), r.Msg.IsReceiptMsg():
+			s.transferAck(r)
+		}
+	}()
+	return r
+}
+
+// register creates a user named name with testPwd and returns its id.
+func (s *testServer) register(name string) string {
+	s.t.Helper()
+	resp, err := s.Register(name, testPwd)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return string(resp)
+}
+
+// testClient is a client speaking the protocol on a raw connection with the
+// json codec and acks.
+type testClient struct {
+	s      *testServer
+	conn   net.Conn
+	framer *message.Framer
+	seq    int
+	// addr is the key of the connection on the server, known from the
+	// first message handled
+	addr  string
+	token string
+}
+
+func (s *testServer) dial() *testClient {
+	s.t.Helper()
+	nc, err := net.Dial("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() {
+		_ = nc.Close()
+	})
+	c := &testClient{s: s, conn: nc, framer: message.NewFramer(nc, message.DefaultMaxFrameSize)}
+	body, err := message.PackHandshake(message.ProtocolVersion, "test", message.CapCodecJSON|message.CapAck)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	hello, err := message.Pack(message.HandshakeCodec, message.MsgTypeHandshake, nil, body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if err = c.framer.WriteFrame(hello); err != nil {
+		s.t.Fatal(err)
+	}
+	msg := c.read()
+	ack, err := message.UnpackHandshakeAck(msg.Body)
+	if err != nil || ack.Code != message.CodeOk {
+		s.t.Fatalf("handshake answered with %+v, err: %v", ack, err)
+	}
+	return c
+}
+
+func (c *testClient) write(msgType message.MsgType, head, body []byte) {
+	c.s.t.Helper()
+	msg, err := message.Pack(message.JSONCodec, msgType, head, body)
+	if err != nil {
+		c.s.t.Fatal(err)
+	}
+	if err = c.framer.WriteFrame(msg); err != nil {
+		c.s.t.Fatal(err)
+	}
+	r := c.s.handleNext()
+	if c.addr == "" {
+		c.addr = r.Addr
+	} else if r.Addr != c.addr {
+		c.s.t.Fatalf("handled a message from %s, want %s", r.Addr, c.addr)
+	}
+}
+
+// read returns the next message sent to the client.
+func (c *testClient) read() message.Message {
+	c.s.t.Helper()
+	msg, err := c.tryRead()
+	if err != nil {
+		c.s.t.Fatal(err)
+	}
+	return msg
+}
+
+func (c *testClient) tryRead() (message.Message, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := c.framer.ReadFrame()
+	if err != nil {
+		return message.Message{}, err
+	}
+	codec := message.JSONCodec
+	if c.addr == "" {
+		codec = message.HandshakeCodec
+	}
+	return message.Unpack(codec, data)
+}
+
+// readType returns the next message of msgType, skipping presence updates
+// and the like.
+func (c *testClient) readType(msgType message.MsgType) message.Message {
+	c.s.t.Helper()
+	for {
+		msg := c.read()
+		if msg.MsgType == msgType {
+			return msg
+		}
+	}
+}
+
+// call sends a request with the token of the client and returns the code
+// and body of the response.
+func (c *testClient) call(meta message.ServerMetadata) (message.Code, []byte) {
+	c.s.t.Helper()
+	c.seq++
+	meta.Token = c.token
+	head, err := message.PackRequestHeader(message.JSONCodec, c.conn.LocalAddr().String(), c.seq)
+	if err != nil {
+		c.s.t.Fatal(err)
+	}
+	body, err := message.PackMetadata(message.JSONCodec, &meta)
+	if err != nil {
+		c.s.t.Fatal(err)
+	}
+	c.write(message.MsgTypeReq, head, body)
+	resp := c.readType(message.MsgTypeResp)
+	respHead, err := message.UnpackResponseHeader(message.JSONCodec, resp.Head)
+	if err != nil {
+		c.s.t.Fatal(err)
+	}
+	if respHead.Seq != c.seq || respHead.Op != meta.Operate {
+		c.s.t.Fatalf("response %+v to request %d of %s", respHead, c.seq, meta.Operate)
+	}
+	return respHead.Code, resp.Body
+}
+
+// login logs userid in on the device deviceID, the offline messages that
+// follow are left to the caller.
+func (c *testClient) login(userid, deviceID string) {
+	c.s.t.Helper()
+	code, body := c.call(message.ServerMetadata{
+		Operate:    message.OperateTypeLogin,
+		Username:   userid,
+		Passwd:     testPwd,
+		DeviceID:   deviceID,
+		DeviceName: deviceID,
+	})
+	if code != message.CodeOk {
+		c.s.t.Fatalf("login of %s failed with %s", userid, code)
+	}
+	res, err := message.UnpackLoginResult(message.JSONCodec, body)
+	if err != nil {
+		c.s.t.Fatal(err)
+	}
+	c.token = res.Token
+}
+
+// chat sends text to the user dest and returns the ack of the server.
+func (c *testClient) chat(dest, text string) message.Ack {
+	c.s.t.Helper()
+	return c.chatWith(message.ChatHeader{DestUserID: dest}, text)
+}
+
+// chatWith is chat with the header head, numbered by the client.
+func (c *testClient) chatWith(head message.ChatHeader, text string) message.Ack {
+	c.s.t.Helper()
+	c.seq++
+	head.Seq = c.seq
+	head.ClientMsgID = fmt.Sprintf("%s-%d", c.conn.LocalAddr(), c.seq)
+	buf, err := message.PackChatHeader(message.JSONCodec, &head)
+	if err != nil {
+		c.s.t.Fatal(err)
+	}
+	c.write(message.MsgTypeChat, buf, []byte(text))
+	ack, err := message.UnpackAck(message.JSONCodec, c.readType(message.MsgTypeAck).Body)
+	if err != nil {
+		c.s.t.Fatal(err)
+	}
+	if ack.Seq != c.seq {
+		c.s.t.Fatalf("ack %+v to chat message %d", ack, c.seq)
+	}
+	return ack
+}
+
+// readChat returns the header and text of the next chat message.
+func (c *testClient) readChat() (message.ChatHeader, string) {
+	c.s.t.Helper()
+	msg := c.readType(message.MsgTypeChat)
+	head, err := message.UnpackChatHeader(message.JSONCodec, msg.Head)
+	if err != nil {
+		c.s.t.Fatal(err)
+	}
+	return head, string(msg.Body)
+}
+
+func TestLoginFlushesInbox(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := s.register("alice"), s.register("bob")
+
+	// far more than the send queue holds, and than the socket buffers do
+	const n = 1000
+	text := string(make([]byte, 16<<10))
+	for i := 1; i <= n; i++ {
+		err := s.inbox.Push(bob, message.ChatRecord{
+			ID:          int64(i),
+			SrcUserID:   alice,
+			DestUserID:  bob,
+			Body:        []byte(text),
+			Time:        time.Now().UnixNano() / int64(time.Millisecond),
+			ClientMsgID: fmt.Sprint(i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := s.dial()
+	c.login(bob, "phone")
+	for i := 1; i <= n; i++ {
+		head, body := c.readChat()
+		if head.MsgID != int64(i) || head.SrcUserID != alice || head.ClientMsgID != fmt.Sprint(i) || body != text {
+			t.Fatalf("offline message %d is %+v", i, head)
+		}
+	}
+	s.handling.Wait()
+	if msgs, _ := s.inbox.Drain(bob); len(msgs) != 0 {
+		t.Fatalf("%d messages left in the inbox after the login", len(msgs))
+	}
+}
+
+func TestLoginKeepsUnsentInbox(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := s.register("alice"), s.register("bob")
+	const n = 1000
+	for i := 1; i <= n; i++ {
+		err := s.inbox.Push(bob, message.ChatRecord{
+			ID:         int64(i),
+			SrcUserID:  alice,
+			DestUserID: bob,
+			Body:       make([]byte, 16<<10),
+			Time:       time.Now().UnixNano() / int64(time.Millisecond),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the client goes away in the middle of the flush
+	c := s.dial()
+	c.login(bob, "phone")
+	for i := 1; i <= 10; i++ {
+		if head, _ := c.readChat(); head.MsgID != int64(i) {
+			t.Fatalf("offline message %d is %+v", i, head)
+		}
+	}
+	_ = c.conn.Close()
+	s.handling.Wait()
+
+	// what did not make it into the send queue is kept for the next login
+	msgs, err := s.inbox.Drain(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) == 0 || len(msgs) > n-10 || msgs[len(msgs)-1].ID != n {
+		t.Fatalf("%d messages kept in the inbox", len(msgs))
+	}
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/server/conn"
+	"github.com/byronzhu-haha/log"
+	"time"
+)
+
+var (
+	errNotFoundSession = errors.New("not found session")
+	errRevokeCurrent   = errors.New("can not revoke the current session, log out instead")
+)
+
+func deviceOf(meta message.ServerMetadata) conn.Device {
+	return conn.Device{ID: meta.DeviceID, Name: meta.DeviceName}
+}
+
+func newDeviceID() (string, error) {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ListSessions returns the sessions of userid on all their devices, marking
+// the one at addr.
+func (s *ChatServer) ListSessions(c message.Codec, addr, userid string) (resp []byte, err error) {
+	sessions := s.connManager.UserSessions(userid)
+	list := make(message.SessionList, 0, len(sessions))
+	for _, sess := range sessions {
+		list = append(list, message.Session{
+			DeviceID:   sess.Device.ID,
+			DeviceName: sess.Device.Name,
+			Addr:       sess.Remote,
+			Since:      sess.Since.UnixNano() / int64(time.Millisecond),
+			Current:    sess.Addr == addr,
+		})
+	}
+	return list.Marshal(c)
+}
+
+// RevokeSession logs userid out on the device deviceID and closes its
+// connection; the client there can not resume the session.
+func (s *ChatServer) RevokeSession(addr, userid, deviceID string) (resp []byte, err error) {
+	found := false
+	for _, sess := range s.connManager.UserSessions(userid) {
+		if sess.Device.ID != deviceID {
+			continue
+		}
+		if sess.Addr == addr {
+			return resp, errRevokeCurrent
+		}
+		s.dropSession(sess)
+		found = true
+	}
+	if !found {
+		return resp, errNotFoundSession
+	}
+	return
+}
+
+// dropSession ends sess, which is not the session of the caller, and closes
+// its connection. The user stays online on the connection of the caller.
+func (s *ChatServer) dropSession(sess conn.Session) {
+	s.revoke(sess.Token)
+	s.connManager.Unbind(sess.Addr)
+	err := s.connManager.Disconnect(sess.Addr)
+	if err != nil {
+		log.Warnf("close conn(%s) of revoked session failed, err: %+v", sess.Addr, err)
+	}
+}
+
+// revoke makes token invalid. If the revocation can not be stored, it is
+// only forgotten on restart.
+func (s *ChatServer) revoke(token string) {
+	err := s.tokens.Revoke(token)
+	if err != nil {
+		log.Errorf("store revoked token failed, err: %+v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/server/auth"
+	"testing"
+)
+
+func (c *testClient) sessions() message.SessionList {
+	c.s.t.Helper()
+	code, body := c.call(message.ServerMetadata{Operate: message.OperateTypeListSessions})
+	if code != message.CodeOk {
+		c.s.t.Fatalf("list sessions failed with %s", code)
+	}
+	var list message.SessionList
+	if err := list.Unmarshal(message.JSONCodec, body); err != nil {
+		c.s.t.Fatal(err)
+	}
+	return list
+}
+
+func TestSessions(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.register("alice")
+	phone, laptop := s.dial(), s.dial()
+	phone.login(alice, "phone")
+	laptop.login(alice, "laptop")
+
+	list := phone.sessions()
+	if len(list) != 2 {
+		t.Fatalf("sessions %+v", list)
+	}
+	for _, sess := range list {
+		if sess.Current != (sess.DeviceID == "phone") || sess.DeviceName != sess.DeviceID || sess.Since == 0 {
+			t.Fatalf("session %+v", sess)
+		}
+	}
+
+	// neither the current session nor one that does not exist is revoked
+	for _, device := range []string{"phone", "tablet"} {
+		code, _ := phone.call(message.ServerMetadata{Operate: message.OperateTypeRevokeSession, DeviceID: device})
+		if code != message.CodeFailed {
+			t.Fatalf("revoke session on %s answered with %s", device, code)
+		}
+	}
+
+	// the revoked session is gone with its connection and its token
+	code, _ := phone.call(message.ServerMetadata{Operate: message.OperateTypeRevokeSession, DeviceID: "laptop"})
+	if code != message.CodeOk {
+		t.Fatalf("revoke session on laptop failed with %s", code)
+	}
+	for {
+		if _, err := laptop.tryRead(); err != nil {
+			break
+		}
+	}
+	if _, err := s.tokens.Verify(laptop.token); err != auth.ErrUnauthorized {
+		t.Fatalf("verify token of revoked session, err: %v", err)
+	}
+	if list = phone.sessions(); len(list) != 1 || list[0].DeviceID != "phone" {
+		t.Fatalf("sessions after revoke %+v", list)
+	}
+
+	// a login on a device with a session replaces it
+	again := s.dial()
+	again.login(alice, "phone")
+	if list = again.sessions(); len(list) != 1 || !list[0].Current {
+		t.Fatalf("sessions after login on the same device %+v", list)
+	}
+	if _, err := s.tokens.Verify(phone.token); err != auth.ErrUnauthorized {
+		t.Fatalf("verify token of replaced session, err: %v", err)
+	}
+}
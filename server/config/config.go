@@ -0,0 +1,122 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"github.com/byronzhu-haha/chat/common/conf"
+	"time"
+)
+
+const (
+	defaultConfigFile = "./server/bin/config.yaml"
+	envPrefix         = "CHAT_SERVER"
+)
+
+type Config struct {
+	ListenAddr    string `yaml:"ListenAddr" default:":4567" usage:"address the server listens on"`
+	ChanSize      int    `yaml:"ChanSize" default:"1000" usage:"buffer size of the message channels"`
+	ReadTimeout   int    `yaml:"ReadTimeout" default:"3" usage:"read deadline of a connection in seconds"`
+	WriteTimeout  int    `yaml:"WriteTimeout" default:"1" usage:"write deadline of a connection in seconds"`
+	MaxFrameSize  int    `yaml:"MaxFrameSize" default:"4194304" usage:"max size of a frame in bytes"`
+	SendQueueSize int    `yaml:"SendQueueSize" default:"256" usage:"max number of messages waiting to be written to a connection"`
+	SendOverflow  string `yaml:"SendOverflow" default:"disconnect" usage:"what to do when the send queue of a connection is full: disconnect, drop-oldest or block for up to the write timeout"`
+	MetricsAddr   string `yaml:"MetricsAddr" default:"" usage:"http address serving the send queue stats as json at /debug/queues, off if empty"`
+
+	Storage       string `yaml:"Storage" default:"memory" usage:"user storage backend, memory or file"`
+	DataDir       string `yaml:"DataDir" default:"./data" usage:"directory of the file storage"`
+	SnapshotEvery int    `yaml:"SnapshotEvery" default:"1000" usage:"number of logged changes after which the file storage takes a snapshot"`
+
+	HashMemory  int `yaml:"HashMemory" default:"19456" usage:"argon2id memory of password hashes in KiB"`
+	HashTime    int `yaml:"HashTime" default:"2" usage:"argon2id iterations of password hashes"`
+	HashThreads int `yaml:"HashThreads" default:"1" usage:"argon2id parallelism of password hashes"`
+
+	PasswordMinLength     int  `yaml:"PasswordMinLength" default:"8" usage:"min length of a password"`
+	PasswordMaxLength     int  `yaml:"PasswordMaxLength" default:"128" usage:"max length of a password"`
+	PasswordRequireLetter bool `yaml:"PasswordRequireLetter" default:"true" usage:"a password must contain a letter"`
+	PasswordRequireDigit  bool `yaml:"PasswordRequireDigit" default:"true" usage:"a password must contain a digit"`
+	PasswordRequireSymbol bool `yaml:"PasswordRequireSymbol" default:"false" usage:"a password must contain a symbol"`
+
+	InboxMaxMessages int `yaml:"InboxMaxMessages" default:"1000" usage:"max number of offline messages kept per user, 0 for no limit"`
+	InboxTTL         int `yaml:"InboxTTL" default:"604800" usage:"seconds an offline message is kept, 0 for ever"`
+
+	IdleAway int `yaml:"IdleAway" default:"300" usage:"seconds without activity after which an online user is shown as away, 0 to disable"`
+
+	Heartbeat   int `yaml:"Heartbeat" default:"15" usage:"seconds a connection may be quiet before the server pings it, 0 to never ping"`
+	IdleTimeout int `yaml:"IdleTimeout" default:"45" usage:"seconds a connection may be quiet before the server closes it, 0 to never close"`
+
+	ShutdownTimeout int `yaml:"ShutdownTimeout" default:"10" usage:"seconds the server waits for connections to drain on shutdown"`
+
+	SessionSecret string `yaml:"SessionSecret" default:"" usage:"hmac key of session tokens; if empty, a key kept under DataDir with file storage, otherwise random on every start"`
+	SessionTTL    int    `yaml:"SessionTTL" default:"86400" usage:"lifetime of a session token in seconds"`
+
+	TLSCertFile     string `yaml:"TLSCertFile" default:"" usage:"tls certificate file"`
+	TLSKeyFile      string `yaml:"TLSKeyFile" default:"" usage:"tls private key file"`
+	TLSClientCAFile string `yaml:"TLSClientCAFile" default:"" usage:"ca file used to verify client certificates"`
+}
+
+// String prints the config for the log, with the secrets redacted.
+func (c *Config) String() string {
+	redacted := *c
+	if redacted.SessionSecret != "" {
+		redacted.SessionSecret = "[redacted]"
+	}
+	return fmt.Sprintf("%+v", redacted)
+}
+
+func (c *Config) ReadDeadline() time.Duration {
+	return time.Duration(c.ReadTimeout) * time.Second
+}
+
+func (c *Config) WriteDeadline() time.Duration {
+	return time.Duration(c.WriteTimeout) * time.Second
+}
+
+func (c *Config) SessionLifetime() time.Duration {
+	return time.Duration(c.SessionTTL) * time.Second
+}
+
+func (c *Config) IdleAwayAfter() time.Duration {
+	return time.Duration(c.IdleAway) * time.Second
+}
+
+func (c *Config) PingAfter() time.Duration {
+	return time.Duration(c.Heartbeat) * time.Second
+}
+
+func (c *Config) IdleLimit() time.Duration {
+	return time.Duration(c.IdleTimeout) * time.Second
+}
+
+func (c *Config) ShutdownDeadline() time.Duration {
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
+func (c *Config) InboxLifetime() time.Duration {
+	return time.Duration(c.InboxTTL) * time.Second
+}
+
+// Default returns a config holding only the default values of the fields.
+func Default() *Config {
+	c := &Config{}
+	_ = conf.LoadDefault(c)
+	return c
+}
+
+// Load builds the config from the defaults, the yaml file given by -config,
+// the CHAT_SERVER_* environment variables and the command-line flags, each
+// layer overriding the previous one.
+func Load(args []string) (*Config, error) {
+	var (
+		c    = &Config{}
+		fs   = flag.NewFlagSet("server", flag.ContinueOnError)
+		path = fs.String("config", defaultConfigFile, "path of the yaml config file")
+	)
+	conf.RegisterFlags(fs, c)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := conf.Load(c, *path, envPrefix, fs); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,18 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStringRedactsSecret(t *testing.T) {
+	cfg := Default()
+	cfg.SessionSecret = "do-not-log-me"
+	s := cfg.String()
+	if strings.Contains(s, cfg.SessionSecret) || !strings.Contains(s, "SessionSecret:[redacted]") {
+		t.Fatalf("config prints as %s", s)
+	}
+	if cfg.SessionSecret != "do-not-log-me" {
+		t.Fatal("String changed the config")
+	}
+}
@@ -2,39 +2,135 @@ package conn
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"github.com/byronzhu-haha/chat/entity/message"
-	"github.com/byronzhu-haha/chat/server/repo"
+	"github.com/byronzhu-haha/chat/server/config"
 	"github.com/byronzhu-haha/log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const sendAndRecvG = 1000
-
 type Manager struct {
-	init    bool
-	conns   map[string]*Conn
-	mu      sync.RWMutex
-	stop    chan struct{}
-	postman chan []byte
-	metaCh  chan message.Message
+	init     bool
+	cfg      *config.Config
+	conns    *registry
+	listener net.Listener
+	// draining is set under mu by Drain, no connection is added after it
+	mu       sync.RWMutex
+	draining bool
+	// handshaking holds the connections accepted but not yet registered,
+	// they can not be sent to before the codec is agreed on
+	hsMu        sync.Mutex
+	handshaking map[*Conn]struct{}
+	postman     chan Request
+	metaCh      chan Request
+	caps        message.Capability
+	tlsCfg      *tls.Config
+	// disconnect is called with the address and the user bound to a
+	// connection once it is closed.
+	disconnect func(addr, userid string)
+	// readers counts the connections still passing messages to postman
+	readers  sync.WaitGroup
+	overflow Overflow
+	stats    queueStats
+	// accepted counts the connections, it makes their keys unique
+	accepted uint64
+}
+
+// Request is a decoded message together with the connection it arrived on.
+// Addr is the key of the connection in the Manager, its remote address
+// followed by #n, n counting the accepted connections; the remote address
+// alone may be shared, e.g. by a client that reconnects from the same port
+// before its old connection is removed.
+type Request struct {
+	Addr  string
+	Codec message.Codec
+	Msg   message.Message
 }
 
+// Packer encodes an outgoing message with the codec of the receiving
+// connection.
+type Packer func(c message.Codec) ([]byte, error)
+
 type Conn struct {
-	conn   net.Conn
-	reader chan []byte
-	stop   chan struct{}
+	key        string
+	conn       net.Conn
+	cfg        *config.Config
+	framer     *message.Framer
+	codec      message.Codec
+	reader     chan Request
+	stop       chan struct{}
+	closeOnce  sync.Once
+	supported  message.Capability
+	handshaked bool
+	// acks is set by the handshake if the client negotiated CapAck
+	acks bool
+	// onReady registers the connection once the handshake is done, it
+	// reports false if the connection must be closed instead
+	onReady func(c *Conn) bool
+
+	sessMu sync.RWMutex
+	userid string
+	token  string
+	device Device
+	// since is the time in unix nanoseconds the session was bound
+	since int64
+	// removed is set under sessMu once the connection left the registry
+	removed bool
+
+	onClose func(c *Conn)
+
+	// out is the send queue, written by writeLoop alone; sendMu keeps the
+	// messages of one send together.
+	out      chan outgoing
+	sendMu   sync.Mutex
+	overflow Overflow
+	stats    *queueStats
+	// draining tells read to stop, leaving the connection open for writes
+	draining int32
+	// lastActive is the time in unix nanoseconds the last message other
+	// than a ping or pong was read, lastRead that of the last frame of any
+	// kind and lastPing that of the last ping sent.
+	lastActive int64
+	lastRead   int64
+	lastPing   int64
+}
+
+var (
+	ErrConnNotFound = errors.New("conn not found")
+	ErrNotQueued    = errors.New("message not queued")
+)
+
+// Device identifies the client a session was opened on.
+type Device struct {
+	ID   string
+	Name string
+}
+
+// Session is a login bound to a connection. Addr identifies the connection
+// like Request.Addr, Remote is its remote address.
+type Session struct {
+	Addr   string
+	Remote string
+	UserID string
+	Token  string
+	Device Device
+	Since  time.Time
 }
 
-func NewManager() *Manager {
+func NewManager(cfg *config.Config) *Manager {
 	return &Manager{
-		init:    true,
-		conns:   make(map[string]*Conn),
-		stop:    make(chan struct{}),
-		postman: make(chan []byte, sendAndRecvG),
-		metaCh:  make(chan message.Message, sendAndRecvG),
+		init:        true,
+		cfg:         cfg,
+		conns:       newRegistry(),
+		handshaking: make(map[*Conn]struct{}),
+		postman:     make(chan Request, cfg.ChanSize),
+		metaCh:      make(chan Request, cfg.ChanSize),
+		caps:        message.CapCompression | message.CapAck | message.CapCodecJSON | message.CapCodecProto,
 	}
 }
 
@@ -42,97 +138,300 @@ func (m *Manager) Start() error {
 	if !m.init {
 		return errors.New("manager of conn is not init")
 	}
-	listener, err := net.Listen("tcp", ":4567")
+	var (
+		listener net.Listener
+		err      error
+	)
+	m.overflow, err = ParseOverflow(m.cfg.SendOverflow)
 	if err != nil {
 		return err
 	}
+	if m.tlsCfg == nil && m.cfg.TLSCertFile != "" {
+		m.tlsCfg, err = LoadTLSConfig(TLSOptions{
+			CertFile:     m.cfg.TLSCertFile,
+			KeyFile:      m.cfg.TLSKeyFile,
+			ClientCAFile: m.cfg.TLSClientCAFile,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if m.tlsCfg != nil {
+		listener, err = tls.Listen("tcp", m.cfg.ListenAddr, m.tlsCfg)
+	} else {
+		listener, err = net.Listen("tcp", m.cfg.ListenAddr)
+	}
+	if err != nil {
+		return err
+	}
+	m.listener = listener
 	go m.accept(listener)
+	go m.transferMsg()
 	return nil
 }
 
+// OnDisconnect registers fn to be called with the address of a connection and
+// the user logged in on it, if any, after the connection was closed and
+// removed. It must be called before Start, fn is called from the goroutine
+// of the connection.
+func (m *Manager) OnDisconnect(fn func(addr, userid string)) {
+	m.disconnect = fn
+}
+
+// EnableTLS makes Start listen with cfg instead of the tls files from the
+// server config; it must be called before Start.
+func (m *Manager) EnableTLS(cfg *tls.Config) {
+	m.tlsCfg = cfg
+}
+
 func (m *Manager) accept(listener net.Listener) {
 	for {
-		if m.check() {
-			break
-		}
-
 		conn, err := listener.Accept()
 		if err != nil {
+			if m.isDraining() {
+				return
+			}
 			log.Errorf("accept failed, err: %+v", err)
 			continue
 		}
-		c := newConn(conn)
-		m.mu.Lock()
-		m.conns[conn.RemoteAddr().String()] = c
-		m.mu.Unlock()
+		c := newConn(conn, m.cfg, m.caps)
+		c.key = fmt.Sprintf("%s#%d", conn.RemoteAddr(), atomic.AddUint64(&m.accepted, 1))
+		c.onClose = m.remove
+		c.onReady = m.register
+		c.overflow = m.overflow
+		c.stats = &m.stats
+		m.mu.RLock()
+		if m.draining {
+			m.mu.RUnlock()
+			_ = conn.Close()
+			return
+		}
+		m.hsMu.Lock()
+		m.handshaking[c] = struct{}{}
+		m.hsMu.Unlock()
+		m.readers.Add(1)
+		m.mu.RUnlock()
 
-		c.start(m.postman)
+		c.start(m.postman, m.readers.Done)
 	}
 }
 
+// transferMsg hands requests, chat messages and their acks over to the
+// receiver of HandleMetadata, routing is up to the server. It returns once
+// postman is closed by Drain.
 func (m *Manager) transferMsg() {
-	for bytes := range m.postman {
-		if m.check() {
-			return
-		}
-		msg, err := message.Unpack(bytes)
-		if err != nil {
-			log.Errorf("unpack message failed, err: %+v", err)
-			continue
+	defer close(m.metaCh)
+	for req := range m.postman {
+		switch req.Msg.MsgType {
+		case message.MsgTypeReq, message.MsgTypeChat, message.MsgTypeAck, message.MsgTypeReceipt:
+			m.metaCh <- req
+		default:
+			log.Warnf("invalid msg type %d from %s", req.Msg.MsgType, req.Addr)
 		}
-		if msg.IsRequestMsg() {
-			m.sendMetadata(msg)
-			continue
-		}
-		if !msg.IsChatMsg() {
-			log.Warnf("invalid msg type, it should be chat msg")
+	}
+}
+
+// Broadcast sends the message to every connection, iterating a snapshot of
+// the registry without locking it.
+func (m *Manager) Broadcast(pack Packer) {
+	m.conns.each(func(c *Conn) bool {
+		c.send(pack)
+		return true
+	})
+}
+
+func (m *Manager) SendMsg(addr string, pack Packer) error {
+	return m.SendMsgs(addr, pack)
+}
+
+// SendMsgs writes the messages to the connection at addr one after another,
+// keeping their order. It fails with ErrNotQueued if the connection could
+// not take all of them, in which case the rest were dropped.
+func (m *Manager) SendMsgs(addr string, packs ...Packer) error {
+	conn, ok := m.conns.get(addr)
+	if !ok {
+		return ErrConnNotFound
+	}
+	if conn.send(packs...) < len(packs) {
+		return ErrNotQueued
+	}
+	return nil
+}
+
+// SendBacklog is SendMsgs for a batch that may be larger than the send
+// queue, such as the offline messages at login: instead of the overflow
+// policy it waits for room, a write deadline at most for each message. It
+// returns how many of the messages were queued, so that the caller can keep
+// the rest.
+func (m *Manager) SendBacklog(addr string, packs ...Packer) (int, error) {
+	conn, ok := m.conns.get(addr)
+	if !ok {
+		return 0, ErrConnNotFound
+	}
+	n := conn.sendWith(OverflowBlock, packs...)
+	if n < len(packs) {
+		return n, ErrNotQueued
+	}
+	return n, nil
+}
+
+// SendToUser sends the messages to every connection userid is logged in on
+// and returns how many there were.
+func (m *Manager) SendToUser(userid string, packs ...Packer) int {
+	return m.SendToOthers(userid, "", packs...)
+}
+
+// SendToOthers is SendToUser leaving out the connection at addr. Only the
+// connections that queued all of the messages are counted.
+func (m *Manager) SendToOthers(userid, addr string, packs ...Packer) int {
+	n := 0
+	for _, conn := range m.conns.byUser(userid) {
+		if conn.addr() == addr {
 			continue
 		}
-		head, err := message.UnpackChatHeader(msg.Head)
-		if err != nil {
-			log.Errorf("unmarshal header failed, err: %+v", err)
-			continue
+		if conn.send(packs...) == len(packs) {
+			n++
 		}
-		addr, err := repo.GetUserIP(head.DestUserID)
-		if err != nil {
-			log.Errorf("get ip for user(%s) failed, err: %+v", head.DestUserID, err)
+	}
+	return n
+}
+
+// SendAck is SendMsg for acks and receipts, which only go to connections
+// that negotiated CapAck.
+func (m *Manager) SendAck(addr string, pack Packer) error {
+	conn, ok := m.conns.get(addr)
+	if !ok {
+		return ErrConnNotFound
+	}
+	if conn.acks {
+		conn.send(pack)
+	}
+	return nil
+}
+
+// SendAckToUser is SendToUser for acks and receipts, it leaves out the
+// connections that did not negotiate CapAck.
+func (m *Manager) SendAckToUser(userid string, pack Packer) int {
+	n := 0
+	for _, conn := range m.conns.byUser(userid) {
+		if conn.acks && conn.send(pack) == 1 {
+			n++
 		}
-		m.mu.RLock()
-		conn, ok := m.conns[addr]
-		m.mu.RUnlock()
-		if !ok {
-			log.Infof("user is not online, receive: %s, sender: %d", head.DestUserID, head.SrcUserID)
-			continue
+	}
+	return n
+}
+
+// UserConns returns the addresses of the connections userid is logged in on.
+func (m *Manager) UserConns(userid string) []string {
+	conns := m.conns.byUser(userid)
+	addrs := make([]string, 0, len(conns))
+	for _, conn := range conns {
+		addrs = append(addrs, conn.addr())
+	}
+	return addrs
+}
+
+// UserSessions returns the sessions of userid, one per connection.
+func (m *Manager) UserSessions(userid string) []Session {
+	conns := m.conns.byUser(userid)
+	res := make([]Session, 0, len(conns))
+	for _, conn := range conns {
+		conn.sessMu.RLock()
+		if conn.userid == userid {
+			res = append(res, Session{
+				Addr:   conn.addr(),
+				Remote: conn.remote(),
+				UserID: conn.userid,
+				Token:  conn.token,
+				Device: conn.device,
+				Since:  time.Unix(0, conn.since),
+			})
 		}
+		conn.sessMu.RUnlock()
+	}
+	return res
+}
 
-		conn.write(bytes)
+// Disconnect closes the connection at addr. The disconnect hook runs on
+// another goroutine, so it may be called from the receiver of the hook.
+func (m *Manager) Disconnect(addr string) error {
+	conn, ok := m.conns.get(addr)
+	if !ok {
+		return ErrConnNotFound
 	}
+	go conn.close()
+	return nil
 }
 
-func (m *Manager) Broadcast(msg []byte) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	for _, conn := range m.conns {
-		conn.write(msg)
+// Bind attaches the session of userid, identified by token and opened on
+// device, to the connection at addr.
+func (m *Manager) Bind(addr, userid, token string, device Device) error {
+	conn, ok := m.conns.get(addr)
+	if !ok {
+		return ErrConnNotFound
 	}
+	conn.sessMu.Lock()
+	defer conn.sessMu.Unlock()
+	if conn.removed {
+		return ErrConnNotFound
+	}
+	if conn.userid != userid {
+		m.conns.unbindUser(conn.userid, conn)
+		m.conns.bindUser(userid, conn)
+	}
+	conn.userid = userid
+	conn.token = token
+	conn.device = device
+	conn.since = time.Now().UnixNano()
+	return nil
 }
 
-func (m *Manager) SendMsg(addr string, data []byte) {
-	m.mu.RLock()
-	conn, ok := m.conns[addr]
-	m.mu.RUnlock()
+func (m *Manager) Unbind(addr string) {
+	_ = m.Bind(addr, "", "", Device{})
+}
+
+// Session returns the session bound to the connection at addr.
+func (m *Manager) Session(addr string) (userid, token string, ok bool) {
+	conn, exist := m.conns.get(addr)
+	if !exist {
+		return "", "", false
+	}
+	conn.sessMu.RLock()
+	defer conn.sessMu.RUnlock()
+	return conn.userid, conn.token, conn.userid != ""
+}
+
+// Sessions returns the users logged in by the address of their connection.
+func (m *Manager) Sessions() map[string]string {
+	res := make(map[string]string)
+	m.conns.each(func(c *Conn) bool {
+		c.sessMu.RLock()
+		if c.userid != "" {
+			res[c.addr()] = c.userid
+		}
+		c.sessMu.RUnlock()
+		return true
+	})
+	return res
+}
+
+// Idle returns how long ago the last message arrived on the connection at
+// addr.
+func (m *Manager) Idle(addr string) (time.Duration, bool) {
+	conn, ok := m.conns.get(addr)
 	if !ok {
-		return
+		return 0, false
 	}
-	conn.write(data)
+	return time.Since(time.Unix(0, atomic.LoadInt64(&conn.lastActive))), true
 }
 
-func (m *Manager) HandleMetadata(ctx context.Context, receiver chan<- message.Message) {
+// HandleMetadata passes the messages of all connections on to receiver until
+// ctx is done or the manager is drained and every message read before was
+// passed on; it closes receiver then.
+func (m *Manager) HandleMetadata(ctx context.Context, receiver chan<- Request) {
 	go func() {
+		defer close(receiver)
 		for meta := range m.metaCh {
-			if m.check() {
-				break
-			}
 			select {
 			case <-ctx.Done():
 				return
@@ -142,87 +441,329 @@ func (m *Manager) HandleMetadata(ctx context.Context, receiver chan<- message.Me
 	}()
 }
 
-func (m *Manager) sendMetadata(msg message.Message) {
+// register makes c reachable once its handshake is done, unless the manager
+// is draining.
+func (m *Manager) register(c *Conn) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	m.hsMu.Lock()
+	delete(m.handshaking, c)
+	m.hsMu.Unlock()
+	if m.draining {
+		return false
+	}
+	m.conns.add(c.addr(), c)
+	return true
+}
+
+// remove drops c from the connections once it is closed.
+func (m *Manager) remove(c *Conn) {
+	addr := c.addr()
+	m.hsMu.Lock()
+	delete(m.handshaking, c)
+	m.hsMu.Unlock()
+	m.conns.remove(addr, c)
+
+	c.sessMu.Lock()
+	userid := c.userid
+	c.removed = true
+	m.conns.unbindUser(userid, c)
+	c.sessMu.Unlock()
+	if m.disconnect != nil {
+		m.disconnect(addr, userid)
+	}
+}
+
+func (m *Manager) isDraining() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.draining
+}
+
+// Drain starts a shutdown: it stops accepting connections, sends goAway to
+// every connection and stops reading from them, leaving them open for the
+// answers to the messages read before. The receiver of HandleMetadata is
+// closed once those messages are passed on.
+func (m *Manager) Drain(goAway Packer) {
+	m.mu.Lock()
+	if m.draining {
+		m.mu.Unlock()
+		return
+	}
+	m.draining = true
+	m.mu.Unlock()
+	conns := m.conns.all()
+
+	if m.listener != nil {
+		_ = m.listener.Close()
+	}
+	// connections still in the handshake have no codec to tell them
+	m.hsMu.Lock()
+	handshaking := make([]*Conn, 0, len(m.handshaking))
+	for c := range m.handshaking {
+		handshaking = append(handshaking, c)
+	}
+	m.hsMu.Unlock()
+	for _, c := range handshaking {
+		c.close()
+	}
+	for _, conn := range conns {
+		// a client too slow to take it learns from the close
+		conn.offer(goAway)
+		conn.stopReading()
+	}
 	go func() {
-		if m.check() {
-			return
-		}
-		m.metaCh <- msg
+		m.readers.Wait()
+		close(m.postman)
 	}()
 }
 
-func (m *Manager) check() (ok bool) {
-	select {
-	case <-m.stop:
-		m.conns = nil
-		ok = true
-	default:
-		ok = false
+// Close waits until the queued messages are written, or until ctx is done,
+// and closes every connection. It must be called after Drain.
+func (m *Manager) Close(ctx context.Context) error {
+	conns := m.conns.all()
+	log.Infof("send queues before close: %+v", m.QueueStats())
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+			c.flush(ctx)
+		}(conn)
+	}
+	wg.Wait()
+	for _, conn := range conns {
+		conn.close()
 	}
-	return
+	return ctx.Err()
 }
 
-func (m *Manager) Stop() {
-	for _, conn := range m.conns {
-		conn.close()
+// QueueStats reports the depth of the send queues of the connections.
+func (m *Manager) QueueStats() QueueStats {
+	s := QueueStats{
+		Conns:       m.conns.len(),
+		Capacity:    queueSize(m.cfg),
+		Peak:        atomic.LoadInt64(&m.stats.peak),
+		Dropped:     atomic.LoadUint64(&m.stats.dropped),
+		Disconnects: atomic.LoadUint64(&m.stats.disconnects),
+	}
+	m.conns.each(func(c *Conn) bool {
+		depth := len(c.out)
+		s.Queued += depth
+		if depth > s.Deepest {
+			s.Deepest = depth
+		}
+		return true
+	})
+	return s
+}
+
+// QueueDepth returns the number of messages waiting to be written to the
+// connection at addr.
+func (m *Manager) QueueDepth(addr string) (int, bool) {
+	conn, ok := m.conns.get(addr)
+	if !ok {
+		return 0, false
 	}
-	close(m.stop)
-	close(m.postman)
-	close(m.metaCh)
+	return len(conn.out), true
 }
 
-func newConn(conn net.Conn) *Conn {
+func queueSize(cfg *config.Config) int {
+	if cfg.SendQueueSize > 0 {
+		return cfg.SendQueueSize
+	}
+	return defaultSendQueueSize
+}
+
+func newConn(conn net.Conn, cfg *config.Config, supported message.Capability) *Conn {
 	return &Conn{
-		conn:   conn,
-		reader: make(chan []byte),
-		stop:   make(chan struct{}),
+		conn:       conn,
+		cfg:        cfg,
+		framer:     message.NewFramer(conn, cfg.MaxFrameSize),
+		codec:      message.GobCodec,
+		reader:     make(chan Request),
+		stop:       make(chan struct{}),
+		out:        make(chan outgoing, queueSize(cfg)),
+		supported:  supported,
+		lastActive: time.Now().UnixNano(),
+		lastRead:   time.Now().UnixNano(),
 	}
 }
 
-func (c *Conn) start(postman chan<- []byte) {
+// start reads from the connection, passing the messages on to postman, and
+// calls done once no more messages are passed on; the queued messages are
+// written by a single writer.
+func (c *Conn) start(postman chan<- Request, done func()) {
+	go c.writeLoop()
 	go c.read()
-	go c.send(postman)
+	go c.deliver(postman, done)
 }
 
-func (c *Conn) send(receiver chan<- []byte) {
-	for bytes := range c.reader {
-		if c.check() {
-			break
-		}
-		receiver <- bytes
+func (c *Conn) deliver(receiver chan<- Request, done func()) {
+	defer done()
+	for req := range c.reader {
+		receiver <- req
 	}
 }
 
+// stopReading makes read return without closing the connection.
+func (c *Conn) stopReading() {
+	atomic.StoreInt32(&c.draining, 1)
+	_ = c.conn.SetReadDeadline(time.Now())
+}
+
+func (c *Conn) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// read passes the messages of the connection on to reader until it fails,
+// is closed or stays quiet for longer than the IdleTimeout of the config.
 func (c *Conn) read() {
+	defer close(c.reader)
 	for {
-		if c.check() {
+		if c.check() || c.isDraining() {
 			break
 		}
-		var buf []byte
-		_ = c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
-		_, err := c.conn.Read(buf)
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.cfg.ReadDeadline()))
+		buf, err := c.framer.ReadFrame()
+		if c.isDraining() && err != nil {
+			return
+		}
 		if err != nil {
-			log.Errorf("read data from conn(%s) failed, err: %+v", c.addr(), err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && c.heartbeat() {
+				continue
+			}
+			if !c.check() {
+				log.Errorf("read data from conn(%s) failed, err: %+v", c.addr(), err)
+			}
+			c.close()
+			return
+		}
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+		if !c.handshaked {
+			if err = c.handshake(buf); err != nil {
+				log.Errorf("handshake with conn(%s) failed, err: %+v", c.addr(), err)
+				c.close()
+				return
+			}
+			if c.onReady != nil && !c.onReady(c) {
+				c.close()
+				return
+			}
+			continue
+		}
+		msg, err := message.Unpack(c.codec, buf)
+		if err != nil {
+			log.Errorf("unpack message from conn(%s) failed, err: %+v", c.addr(), err)
+			continue
+		}
+		switch {
+		case msg.IsPingMsg():
+			c.send(message.PackPong)
+			continue
+		case msg.IsPongMsg():
 			continue
 		}
-		c.reader <- buf
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+		select {
+		case <-c.stop:
+			return
+		case c.reader <- Request{
+			Addr:  c.addr(),
+			Codec: c.codec,
+			Msg:   msg,
+		}:
+		}
 	}
 }
 
-func (c *Conn) write(buf []byte) {
-	go func(buf []byte) {
-		if c.check() {
-			return
-		}
-		_ = c.conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
-		_, err := c.conn.Write(buf)
+// heartbeat pings the peer once the connection has been quiet for the
+// Heartbeat of the config and reports false once it has been quiet for
+// longer than the IdleTimeout.
+func (c *Conn) heartbeat() bool {
+	now := time.Now().UnixNano()
+	quiet := time.Duration(now - atomic.LoadInt64(&c.lastRead))
+	if limit := c.cfg.IdleLimit(); limit > 0 && quiet > limit {
+		log.Warnf("conn(%s) has been quiet for %s, close it", c.addr(), quiet)
+		return false
+	}
+	every := c.cfg.PingAfter()
+	if !c.handshaked || every <= 0 || quiet < every || time.Duration(now-c.lastPing) < every {
+		return true
+	}
+	c.lastPing = now
+	c.send(message.PackPing)
+	return true
+}
+
+func (c *Conn) handshake(buf []byte) error {
+	msg, err := message.Unpack(message.HandshakeCodec, buf)
+	if err != nil {
+		return err
+	}
+	if !msg.IsHandshakeMsg() {
+		return errors.New("first message must be handshake")
+	}
+	hs, err := message.UnpackHandshake(msg.Body)
+	if err != nil {
+		return err
+	}
+	ack := message.Negotiate(hs, c.supported)
+	body, err := message.PackHandshakeAck(ack.Version, ack.Code, ack.Capabilities)
+	if err != nil {
+		return err
+	}
+	resp, err := message.Pack(message.HandshakeCodec, message.MsgTypeHandshake, nil, body)
+	if err != nil {
+		return err
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteDeadline()))
+	err = c.framer.WriteFrame(resp)
+	if err != nil {
+		return err
+	}
+	if ack.Code != message.CodeOk {
+		return fmt.Errorf("client(%s) version %d is incompatible", hs.ClientName, hs.Version)
+	}
+	if ack.Capabilities.Has(message.CapCompression) {
+		c.framer.EnableCompression()
+	}
+	c.codec = ack.Capabilities.Codec()
+	c.acks = ack.Capabilities.Has(message.CapAck)
+	c.handshaked = true
+	log.Infof("handshake with client(%s) at %s done, version: %d, codec: %s, caps: %b",
+		hs.ClientName, c.addr(), ack.Version, c.codec.Name(), ack.Capabilities)
+	return nil
+}
+
+// send queues the messages under the overflow policy of the connection and
+// returns how many of them it queued, see enqueue.
+func (c *Conn) send(packs ...Packer) int {
+	return c.sendWith(c.overflow, packs...)
+}
+
+// sendWith is send under policy. A message that fails to pack is skipped,
+// it would not pack on a retry either.
+func (c *Conn) sendWith(policy Overflow, packs ...Packer) int {
+	bufs := make([][]byte, len(packs))
+	for i, pack := range packs {
+		buf, err := pack(c.codec)
 		if err != nil {
-			log.Errorf("write date to conn(%s) failed, err: %+v", c.addr(), err)
+			log.Errorf("pack message for conn(%s) failed, err: %+v", c.addr(), err)
+			continue
 		}
-	}(buf)
+		bufs[i] = buf
+	}
+	return c.enqueue(bufs, policy)
 }
 
+// addr returns the key of the connection, see Request.
 func (c *Conn) addr() string {
+	return c.key
+}
+
+func (c *Conn) remote() string {
 	return c.conn.RemoteAddr().String()
 }
 
@@ -237,7 +778,11 @@ func (c *Conn) check() (ok bool) {
 }
 
 func (c *Conn) close() {
-	close(c.stop)
-	close(c.reader)
-	_ = c.conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		_ = c.conn.Close()
+		if c.onClose != nil {
+			c.onClose(c)
+		}
+	})
 }
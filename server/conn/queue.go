@@ -0,0 +1,220 @@
+package conn
+
+import (
+	"context"
+	"fmt"
+	"github.com/byronzhu-haha/log"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow decides what happens to a message sent to a connection whose send
+// queue is full.
+type Overflow byte
+
+const (
+	// OverflowBlock makes the sender wait until the queue has room, for a
+	// write deadline at most; a writer stuck for longer is not going to
+	// catch up, so the connection is closed then.
+	OverflowBlock Overflow = iota
+	// OverflowDropOldest drops the oldest queued message to make room.
+	OverflowDropOldest
+	// OverflowDisconnect closes the connection, the client is too slow.
+	OverflowDisconnect
+)
+
+func (o Overflow) String() string {
+	switch o {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+func ParseOverflow(s string) (Overflow, error) {
+	switch s {
+	case "block":
+		return OverflowBlock, nil
+	case "drop-oldest":
+		return OverflowDropOldest, nil
+	case "disconnect", "":
+		return OverflowDisconnect, nil
+	}
+	return 0, fmt.Errorf("unknown send overflow policy %q", s)
+}
+
+const defaultSendQueueSize = 256
+
+// QueueStats describes the send queues of all connections. Queued and
+// Deepest are taken when the stats are read, Peak is the largest depth any
+// queue ever had; Dropped and Disconnects count the overflows.
+type QueueStats struct {
+	Conns       int
+	Queued      int
+	Deepest     int
+	Capacity    int
+	Peak        int64
+	Dropped     uint64
+	Disconnects uint64
+}
+
+// queueStats are the counters shared by the connections of a manager.
+type queueStats struct {
+	peak        int64
+	dropped     uint64
+	disconnects uint64
+}
+
+func (s *queueStats) observe(depth int) {
+	if s == nil {
+		return
+	}
+	for {
+		peak := atomic.LoadInt64(&s.peak)
+		if int64(depth) <= peak || atomic.CompareAndSwapInt64(&s.peak, peak, int64(depth)) {
+			return
+		}
+	}
+}
+
+func (s *queueStats) drop() {
+	if s != nil {
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+func (s *queueStats) disconnect() {
+	if s != nil {
+		atomic.AddUint64(&s.disconnects, 1)
+	}
+}
+
+// outgoing is an entry of the send queue, either a frame to write or, if
+// flushed is set, a marker closed once everything queued before is written.
+type outgoing struct {
+	buf     []byte
+	flushed chan struct{}
+}
+
+// enqueue queues bufs for the writer of the connection, keeping them
+// together and in order, and returns how many of them it queued before one
+// did not fit. A nil buf is skipped but counted.
+func (c *Conn) enqueue(bufs [][]byte, policy Overflow) int {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	for i, buf := range bufs {
+		if buf != nil && !c.push(outgoing{buf: buf}, policy) {
+			return i
+		}
+	}
+	return len(bufs)
+}
+
+// push queues o, handling a full queue according to policy. It reports false
+// if o was not queued. The caller holds sendMu, so no other send takes the
+// room made for o.
+func (c *Conn) push(o outgoing, policy Overflow) bool {
+	select {
+	case <-c.stop:
+		return false
+	case c.out <- o:
+		c.stats.observe(len(c.out))
+		return true
+	default:
+	}
+	switch policy {
+	case OverflowDropOldest:
+		select {
+		case dropped := <-c.out:
+			c.stats.drop()
+			if dropped.flushed != nil {
+				close(dropped.flushed)
+			}
+		default:
+		}
+	case OverflowDisconnect:
+		c.overflowed()
+		return false
+	}
+	wait := time.NewTimer(c.cfg.WriteDeadline())
+	defer wait.Stop()
+	select {
+	case <-c.stop:
+	case c.out <- o:
+		c.stats.observe(len(c.out))
+		return true
+	case <-wait.C:
+		c.overflowed()
+	}
+	return false
+}
+
+// offer queues the message of pack if the queue has room right away and
+// drops it otherwise, whatever the overflow policy. It does not wait for
+// sendMu either, so the message may land amid the messages of a send.
+func (c *Conn) offer(pack Packer) {
+	buf, err := pack(c.codec)
+	if err != nil {
+		log.Errorf("pack message for conn(%s) failed, err: %+v", c.addr(), err)
+		return
+	}
+	select {
+	case c.out <- outgoing{buf: buf}:
+		c.stats.observe(len(c.out))
+	default:
+	}
+}
+
+// overflowed closes the connection, its queue stayed full.
+func (c *Conn) overflowed() {
+	c.stats.disconnect()
+	log.Warnf("send queue of conn(%s) is full, close it", c.addr())
+	// the disconnect hook may need the goroutine sending
+	go c.close()
+}
+
+// writeLoop writes the queued messages one after another until the
+// connection is closed or a write fails, which closes it.
+func (c *Conn) writeLoop() {
+	for {
+		select {
+		case <-c.stop:
+			return
+		case o := <-c.out:
+			if o.flushed != nil {
+				close(o.flushed)
+				continue
+			}
+			_ = c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteDeadline()))
+			err := c.framer.WriteFrame(o.buf)
+			if err != nil {
+				if !c.check() {
+					log.Errorf("write data to conn(%s) failed, err: %+v", c.addr(), err)
+				}
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// flush waits until the messages queued before are written, the connection
+// is closed or ctx is done. It does not take sendMu, which a send may hold
+// for a while.
+func (c *Conn) flush(ctx context.Context) {
+	flushed := make(chan struct{})
+	select {
+	case c.out <- outgoing{flushed: flushed}:
+	case <-c.stop:
+	case <-ctx.Done():
+	}
+	select {
+	case <-flushed:
+	case <-c.stop:
+	case <-ctx.Done():
+	}
+}
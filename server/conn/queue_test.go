@@ -0,0 +1,75 @@
+package conn
+
+import (
+	"github.com/byronzhu-haha/chat/server/config"
+	"io"
+	"testing"
+	"time"
+)
+
+func chatPacks(n int) []Packer {
+	packs := make([]Packer, n)
+	for i := range packs {
+		packs[i] = chatPack
+	}
+	return packs
+}
+
+func TestSendOverflow(t *testing.T) {
+	cfg := config.Default()
+	cfg.SendQueueSize = 16
+	m := NewManager(cfg)
+	c, client := pipePair(m)
+	defer c.close()
+	if !m.register(c) {
+		t.Fatal("register failed")
+	}
+
+	// nobody reads, the queue fills up and the connection is closed
+	err := m.SendMsgs(c.addr(), chatPacks(40)...)
+	if err != ErrNotQueued {
+		t.Fatalf("send 40 messages to a queue of 16, err: %v", err)
+	}
+	select {
+	case <-c.stop:
+	case <-time.After(time.Second):
+		t.Fatal("overflowed connection is not closed")
+	}
+	_ = client.Close()
+}
+
+func TestSendBacklog(t *testing.T) {
+	cfg := config.Default()
+	cfg.SendQueueSize = 16
+	m := NewManager(cfg)
+	c, client := pipePair(m)
+	defer c.close()
+	if !m.register(c) {
+		t.Fatal("register failed")
+	}
+
+	// a backlog larger than the queue waits for the reader instead
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = io.Copy(io.Discard, client)
+	}()
+	n, err := m.SendBacklog(c.addr(), chatPacks(100)...)
+	if err != nil || n != 100 {
+		t.Fatalf("queued %d of 100 messages, err: %v", n, err)
+	}
+
+	// the reader goes away midway, what was not queued is reported
+	c, client = pipePair(m)
+	defer c.close()
+	if !m.register(c) {
+		t.Fatal("register failed")
+	}
+	go func() {
+		_, _ = io.CopyN(io.Discard, client, 512)
+		_ = client.Close()
+	}()
+	n, err = m.SendBacklog(c.addr(), chatPacks(100)...)
+	if err != ErrNotQueued || n >= 100 {
+		t.Fatalf("queued %d of 100 messages to a closed connection, err: %v", n, err)
+	}
+}
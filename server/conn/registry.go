@@ -0,0 +1,158 @@
+package conn
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const registryShards = 256
+
+// registry holds the connections by address and the logged in ones by user,
+// both split into shards so that accepts, routes and closes of different
+// connections rarely wait on the same lock. Each address shard keeps an
+// immutable snapshot of its connections, iterated without locking.
+type registry struct {
+	conns [registryShards]connShard
+	users [registryShards]userShard
+	count int64
+}
+
+type connShard struct {
+	mu    sync.RWMutex
+	conns map[string]*Conn
+	// snapshot holds a []*Conn of conns, replaced on every change
+	snapshot atomic.Value
+}
+
+type userShard struct {
+	mu    sync.RWMutex
+	users map[string]map[*Conn]struct{}
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.conns {
+		r.conns[i].conns = make(map[string]*Conn)
+		r.conns[i].snapshot.Store([]*Conn(nil))
+		r.users[i].users = make(map[string]map[*Conn]struct{})
+	}
+	return r
+}
+
+func shardOf(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32() % registryShards
+}
+
+func (r *registry) add(addr string, c *Conn) {
+	s := &r.conns[shardOf(addr)]
+	s.mu.Lock()
+	if _, ok := s.conns[addr]; !ok {
+		atomic.AddInt64(&r.count, 1)
+	}
+	s.conns[addr] = c
+	s.refresh()
+	s.mu.Unlock()
+}
+
+func (r *registry) get(addr string) (*Conn, bool) {
+	s := &r.conns[shardOf(addr)]
+	s.mu.RLock()
+	c, ok := s.conns[addr]
+	s.mu.RUnlock()
+	return c, ok
+}
+
+// remove drops c unless its address was taken over by another connection,
+// and reports whether it did.
+func (r *registry) remove(addr string, c *Conn) bool {
+	s := &r.conns[shardOf(addr)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[addr] != c {
+		return false
+	}
+	delete(s.conns, addr)
+	atomic.AddInt64(&r.count, -1)
+	s.refresh()
+	return true
+}
+
+// refresh rebuilds the snapshot, the caller holds the lock of the shard.
+func (s *connShard) refresh() {
+	snapshot := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		snapshot = append(snapshot, c)
+	}
+	s.snapshot.Store(snapshot)
+}
+
+// each calls fn for every connection registered when the shard is visited,
+// without holding any lock, until fn returns false.
+func (r *registry) each(fn func(c *Conn) bool) {
+	for i := range r.conns {
+		for _, c := range r.conns[i].snapshot.Load().([]*Conn) {
+			if !fn(c) {
+				return
+			}
+		}
+	}
+}
+
+func (r *registry) all() []*Conn {
+	res := make([]*Conn, 0, r.len())
+	r.each(func(c *Conn) bool {
+		res = append(res, c)
+		return true
+	})
+	return res
+}
+
+func (r *registry) len() int {
+	return int(atomic.LoadInt64(&r.count))
+}
+
+func (r *registry) bindUser(userid string, c *Conn) {
+	if userid == "" {
+		return
+	}
+	s := &r.users[shardOf(userid)]
+	s.mu.Lock()
+	conns, ok := s.users[userid]
+	if !ok {
+		conns = make(map[*Conn]struct{})
+		s.users[userid] = conns
+	}
+	conns[c] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (r *registry) unbindUser(userid string, c *Conn) {
+	if userid == "" {
+		return
+	}
+	s := &r.users[shardOf(userid)]
+	s.mu.Lock()
+	if conns, ok := s.users[userid]; ok {
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(s.users, userid)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// byUser returns the connections userid is logged in on.
+func (r *registry) byUser(userid string) []*Conn {
+	s := &r.users[shardOf(userid)]
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	conns := s.users[userid]
+	res := make([]*Conn, 0, len(conns))
+	for c := range conns {
+		res = append(res, c)
+	}
+	return res
+}
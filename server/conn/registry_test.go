@@ -0,0 +1,141 @@
+package conn
+
+import (
+	"fmt"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/server/config"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+const benchConns = 50000
+
+// pipeConn returns a connection of m over net.Pipe whose client end
+// discards everything written to it.
+func pipeConn(m *Manager) *Conn {
+	c, client := pipePair(m)
+	go func() {
+		_, _ = io.Copy(io.Discard, client)
+	}()
+	return c
+}
+
+// pipePair returns a connection of m over net.Pipe and the client end, which
+// nothing reads from yet.
+func pipePair(m *Manager) (*Conn, net.Conn) {
+	server, client := net.Pipe()
+	c := newConn(server, m.cfg, m.caps)
+	c.key = fmt.Sprintf("%s#%d", server.RemoteAddr(), atomic.AddUint64(&m.accepted, 1))
+	c.onClose = m.remove
+	c.overflow = m.overflow
+	c.stats = &m.stats
+	go c.writeLoop()
+	return c, client
+}
+
+// pipeManager returns a manager with n registered connections, user i/2 is
+// logged in on connections i and i+1.
+func pipeManager(tb testing.TB, n int) (*Manager, []*Conn) {
+	cfg := config.Default()
+	cfg.SendQueueSize = 16
+	cfg.SendOverflow = "drop-oldest"
+	m := NewManager(cfg)
+	var err error
+	m.overflow, err = ParseOverflow(cfg.SendOverflow)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conns := make([]*Conn, n)
+	for i := range conns {
+		conns[i] = pipeConn(m)
+		if !m.register(conns[i]) {
+			tb.Fatal("register failed")
+		}
+		err = m.Bind(conns[i].addr(), fmt.Sprint(i/2), "", Device{})
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	tb.Cleanup(func() {
+		for _, c := range conns {
+			c.close()
+		}
+	})
+	return m, conns
+}
+
+func chatPack(c message.Codec) ([]byte, error) {
+	return message.Pack(c, message.MsgTypeChat, nil, []byte("hello"))
+}
+
+func TestRegistry(t *testing.T) {
+	m, conns := pipeManager(t, 4)
+	if m.conns.len() != 4 || len(m.conns.all()) != 4 {
+		t.Fatalf("%d connections registered, want 4", m.conns.len())
+	}
+	if got := m.UserConns("0"); len(got) != 2 {
+		t.Fatalf("user 0 is on %v, want 2 connections", got)
+	}
+
+	// the keys stay unique though every pipe has the same address
+	if conns[0].remote() != conns[1].remote() || conns[0].addr() == conns[1].addr() {
+		t.Fatalf("keys %s and %s", conns[0].addr(), conns[1].addr())
+	}
+
+	stale := &Conn{key: conns[2].addr()}
+	if m.conns.remove(stale.addr(), stale) {
+		t.Fatal("removed a connection that is not registered")
+	}
+	conns[2].close()
+	if _, ok := m.conns.get(conns[2].addr()); ok || m.conns.len() != 3 {
+		t.Fatal("closed connection still registered")
+	}
+	if got := m.UserConns("1"); len(got) != 1 || got[0] != conns[3].addr() {
+		t.Fatalf("user 1 is on %v, want %s", got, conns[3].addr())
+	}
+
+	m.Unbind(conns[3].addr())
+	if got := m.UserConns("1"); len(got) != 0 {
+		t.Fatalf("user 1 is on %v after unbind", got)
+	}
+}
+
+func BenchmarkRegisterUnregister(b *testing.B) {
+	m, _ := pipeManager(b, benchConns)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c := pipeConn(m)
+		defer c.close()
+		for pb.Next() {
+			m.register(c)
+			m.remove(c)
+		}
+	})
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	m, _ := pipeManager(b, benchConns)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Broadcast(chatPack)
+	}
+}
+
+func BenchmarkSendToUser(b *testing.B) {
+	m, _ := pipeManager(b, benchConns)
+	var next uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			user := atomic.AddUint64(&next, 1) % (benchConns / 2)
+			if m.SendToUser(fmt.Sprint(user), chatPack) != 2 {
+				b.Fatalf("user %d is not on 2 connections", user)
+			}
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package conn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+// issue creates a certificate for name signed by parent, or a self-signed CA
+// when parent is nil.
+func issue(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert},
+	}
+}
+
+// write stores the certificate and key of c as PEM files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// handshake serves one connection with cfg and dials it with client, it
+// returns the errors of both sides.
+func handshake(t *testing.T, cfg, client *tls.Config) (serverErr, clientErr error) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer c.Close()
+		err = c.(*tls.Conn).Handshake()
+		if err == nil {
+			_, err = c.Write([]byte{1})
+		}
+		done <- err
+	}()
+
+	c, err := tls.Dial("tcp", ln.Addr().String(), client)
+	if err == nil {
+		// with TLS 1.3 a rejected client certificate only shows on the first read
+		_, err = c.Read(make([]byte, 1))
+		c.Close()
+	}
+	return <-done, err
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "ca", nil)
+	server := issue(t, "localhost", ca)
+	certFile, keyFile := server.write(t, dir, "server")
+	caFile, _ := ca.write(t, dir, "ca")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	t.Run("plain", func(t *testing.T) {
+		cfg, err := LoadTLSConfig(TLSOptions{CertFile: certFile, KeyFile: keyFile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.ClientAuth != tls.NoClientCert {
+			t.Fatalf("client auth %v without a client ca", cfg.ClientAuth)
+		}
+		serverErr, clientErr := handshake(t, cfg, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		if serverErr != nil || clientErr != nil {
+			t.Fatalf("server: %v, client: %v", serverErr, clientErr)
+		}
+	})
+
+	t.Run("client ca", func(t *testing.T) {
+		cfg, err := LoadTLSConfig(TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.ClientAuth != tls.RequireAndVerifyClientCert {
+			t.Fatalf("client auth %v with a client ca", cfg.ClientAuth)
+		}
+
+		client := issue(t, "client", ca)
+		serverErr, clientErr := handshake(t, cfg, &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: []tls.Certificate{client.pair},
+		})
+		if serverErr != nil || clientErr != nil {
+			t.Fatalf("server: %v, client: %v", serverErr, clientErr)
+		}
+
+		serverErr, clientErr = handshake(t, cfg, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		if serverErr == nil || clientErr == nil {
+			t.Fatalf("client without a certificate accepted, server: %v, client: %v", serverErr, clientErr)
+		}
+
+		stranger := issue(t, "client", issue(t, "other ca", nil))
+		serverErr, _ = handshake(t, cfg, &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: []tls.Certificate{stranger.pair},
+		})
+		if serverErr == nil {
+			t.Fatal("client certificate of an unknown ca accepted")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := LoadTLSConfig(TLSOptions{CertFile: certFile}); err == nil {
+			t.Fatal("missing key file accepted")
+		}
+		if _, err := LoadTLSConfig(TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}); err == nil {
+			t.Fatal("client ca file without certificates accepted")
+		}
+	})
+}
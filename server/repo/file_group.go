@@ -0,0 +1,148 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/byronzhu-haha/chat/entity/group"
+	"sync"
+)
+
+const (
+	groupOpPut byte = iota + 1
+	groupOpDel
+)
+
+type groupEntry struct {
+	Op     byte
+	ID     string
+	Record group.Record
+}
+
+// FileGroupManager is a GroupManager whose changes survive restarts, stored
+// the same way as the users of FileUserManager.
+type FileGroupManager struct {
+	*GroupManager
+	wmu   sync.Mutex
+	store *fileStore
+}
+
+func NewFileGroupManager(dir string, snapshotEvery int) (*FileGroupManager, error) {
+	store, err := openFileStore(dir, "groups", snapshotEvery)
+	if err != nil {
+		return nil, err
+	}
+	m := &FileGroupManager{
+		GroupManager: NewGroupManager(),
+		store:        store,
+	}
+	err = store.load(m.apply, m.records)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *FileGroupManager) apply(rec []byte) error {
+	var e groupEntry
+	err := gob.NewDecoder(bytes.NewReader(rec)).Decode(&e)
+	if err != nil {
+		return err
+	}
+	switch e.Op {
+	case groupOpPut:
+		m.groups[e.ID] = group.FromRecord(e.Record)
+		observeID(e.ID)
+	case groupOpDel:
+		delete(m.groups, e.ID)
+	}
+	return nil
+}
+
+func (m *FileGroupManager) Create(g *group.Group) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	err := m.GroupManager.Create(g)
+	if err != nil {
+		return err
+	}
+	return m.persist(g.ID())
+}
+
+func (m *FileGroupManager) AddMember(groupID, userid string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	err := m.GroupManager.AddMember(groupID, userid)
+	if err != nil {
+		return err
+	}
+	return m.persist(groupID)
+}
+
+func (m *FileGroupManager) DelMember(groupID, userid string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	err := m.GroupManager.DelMember(groupID, userid)
+	if err != nil {
+		return err
+	}
+	return m.persist(groupID)
+}
+
+func (m *FileGroupManager) DelUser(userid string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	for _, id := range m.GroupManager.delUser(userid) {
+		err := m.persist(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *FileGroupManager) Close() error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return m.store.close()
+}
+
+// persist logs the current state of the group, or its deletion if it is
+// gone.
+func (m *FileGroupManager) persist(id string) error {
+	e := groupEntry{Op: groupOpDel, ID: id}
+	m.mu.RLock()
+	if g, ok := m.groups[id]; ok {
+		e.Op = groupOpPut
+		e.Record = g.Record()
+	}
+	m.mu.RUnlock()
+	rec, err := encodeGroupEntry(e)
+	if err != nil {
+		return err
+	}
+	return m.store.append(rec)
+}
+
+func (m *FileGroupManager) records() ([][]byte, error) {
+	m.mu.RLock()
+	records := make([][]byte, 0, len(m.groups))
+	for id, g := range m.groups {
+		rec, err := encodeGroupEntry(groupEntry{Op: groupOpPut, ID: id, Record: g.Record()})
+		if err != nil {
+			m.mu.RUnlock()
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	m.mu.RUnlock()
+	return records, nil
+}
+
+func encodeGroupEntry(e groupEntry) ([]byte, error) {
+	var buf = &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(&e)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
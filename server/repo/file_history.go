@@ -0,0 +1,65 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"sync"
+)
+
+// FileHistory is a MemoryHistory whose messages survive restarts. History
+// only grows, so it is kept as the log of a fileStore that never takes a
+// snapshot.
+type FileHistory struct {
+	*MemoryHistory
+	wmu   sync.Mutex
+	store *fileStore
+}
+
+func NewFileHistory(dir string) (*FileHistory, error) {
+	store, err := openFileStore(dir, "history", 0)
+	if err != nil {
+		return nil, err
+	}
+	h := &FileHistory{
+		MemoryHistory: NewMemoryHistory(),
+		store:         store,
+	}
+	err = store.load(h.apply, nil)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *FileHistory) apply(rec []byte) error {
+	var r message.ChatRecord
+	err := gob.NewDecoder(bytes.NewReader(rec)).Decode(&r)
+	if err != nil {
+		return err
+	}
+	h.add(r)
+	return nil
+}
+
+func (h *FileHistory) Append(rec message.ChatRecord) (message.ChatRecord, error) {
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	rec, err := h.MemoryHistory.Append(rec)
+	if err != nil {
+		return rec, err
+	}
+	var buf = &bytes.Buffer{}
+	err = gob.NewEncoder(buf).Encode(&rec)
+	if err != nil {
+		return rec, err
+	}
+	err = h.store.append(buf.Bytes())
+	return rec, err
+}
+
+func (h *FileHistory) Close() error {
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	return h.store.close()
+}
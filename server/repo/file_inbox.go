@@ -0,0 +1,123 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"sync"
+	"time"
+)
+
+const (
+	inboxOpPush byte = iota + 1
+	inboxOpDrain
+)
+
+type inboxEntry struct {
+	Op     byte
+	UserID string
+	Msg    message.ChatRecord
+}
+
+// FileInbox is a MemoryInbox whose messages survive restarts. A message is
+// written to the log of a fileStore under dir before Push returns. Unlike the
+// user records a push is not idempotent, so a crash right after a snapshot
+// may deliver the messages logged before it twice.
+type FileInbox struct {
+	*MemoryInbox
+	wmu   sync.Mutex
+	store *fileStore
+}
+
+func NewFileInbox(dir string, snapshotEvery, max int, ttl time.Duration) (*FileInbox, error) {
+	store, err := openFileStore(dir, "inbox", snapshotEvery)
+	if err != nil {
+		return nil, err
+	}
+	b := &FileInbox{
+		MemoryInbox: NewMemoryInbox(max, ttl),
+		store:       store,
+	}
+	err = store.load(b.apply, b.records)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *FileInbox) apply(rec []byte) error {
+	var e inboxEntry
+	err := gob.NewDecoder(bytes.NewReader(rec)).Decode(&e)
+	if err != nil {
+		return err
+	}
+	switch e.Op {
+	case inboxOpPush:
+		b.push(e.UserID, e.Msg)
+	case inboxOpDrain:
+		delete(b.boxes, e.UserID)
+	}
+	return nil
+}
+
+func (b *FileInbox) Push(userid string, msg message.ChatRecord) error {
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	err := b.MemoryInbox.Push(userid, msg)
+	if err != nil {
+		return err
+	}
+	return b.persist(inboxEntry{Op: inboxOpPush, UserID: userid, Msg: msg})
+}
+
+// Drain logs the removal after taking the messages out, so a crash in between
+// hands them out again on the next start rather than losing them.
+func (b *FileInbox) Drain(userid string) ([]message.ChatRecord, error) {
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	msgs, err := b.MemoryInbox.Drain(userid)
+	if err != nil || len(msgs) == 0 {
+		return msgs, err
+	}
+	return msgs, b.persist(inboxEntry{Op: inboxOpDrain, UserID: userid})
+}
+
+func (b *FileInbox) Close() error {
+	b.wmu.Lock()
+	defer b.wmu.Unlock()
+	return b.store.close()
+}
+
+func (b *FileInbox) persist(e inboxEntry) error {
+	rec, err := encodeInboxEntry(e)
+	if err != nil {
+		return err
+	}
+	return b.store.append(rec)
+}
+
+func (b *FileInbox) records() ([][]byte, error) {
+	b.mu.Lock()
+	var records [][]byte
+	for userid, box := range b.boxes {
+		for _, msg := range box {
+			rec, err := encodeInboxEntry(inboxEntry{Op: inboxOpPush, UserID: userid, Msg: msg})
+			if err != nil {
+				b.mu.Unlock()
+				return nil, err
+			}
+			records = append(records, rec)
+		}
+	}
+	b.mu.Unlock()
+	return records, nil
+}
+
+func encodeInboxEntry(e inboxEntry) ([]byte, error) {
+	var buf = &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(&e)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,238 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/byronzhu-haha/chat/entity/user"
+	"sync"
+)
+
+const (
+	userOpPut byte = iota + 1
+	userOpDel
+	userOpRevoke
+)
+
+// userEntry is a change of the user ID, or with userOpRevoke a revoked
+// token ID valid until Expiry.
+type userEntry struct {
+	Op     byte
+	ID     string
+	Record user.Record
+	Expiry int64
+}
+
+// FileUserManager is a UserManager whose changes survive restarts. Every
+// mutation is written to the log of a fileStore under dir before it returns.
+type FileUserManager struct {
+	*UserManager
+	wmu   sync.Mutex
+	store *fileStore
+}
+
+func NewFileUserManager(dir string, snapshotEvery int) (*FileUserManager, error) {
+	store, err := openFileStore(dir, "users", snapshotEvery)
+	if err != nil {
+		return nil, err
+	}
+	m := &FileUserManager{
+		UserManager: &UserManager{
+			users:   make(map[string]*user.User),
+			revoked: make(map[string]int64),
+		},
+		store: store,
+	}
+	err = store.load(m.apply, m.records)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *FileUserManager) apply(rec []byte) error {
+	var e userEntry
+	err := gob.NewDecoder(bytes.NewReader(rec)).Decode(&e)
+	if err != nil {
+		return err
+	}
+	switch e.Op {
+	case userOpPut:
+		m.users[e.ID] = user.FromRecord(e.Record)
+		observeID(e.ID)
+	case userOpDel:
+		delete(m.users, e.ID)
+	case userOpRevoke:
+		m.revoked[e.ID] = e.Expiry
+	}
+	return nil
+}
+
+func (m *FileUserManager) Save(u *user.User) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	err := m.UserManager.Save(u)
+	if err != nil {
+		return err
+	}
+	return m.persist(userOpPut, u.ID())
+}
+
+func (m *FileUserManager) Del(id string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	changed := m.UserManager.del(id)
+	err := m.persist(userOpDel, id)
+	if err != nil {
+		return err
+	}
+	for _, other := range changed {
+		err = m.persist(userOpPut, other)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *FileUserManager) AddUserFriend(userid, friendID string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	err := m.UserManager.AddUserFriend(userid, friendID)
+	if err != nil {
+		return err
+	}
+	return m.persistBoth(userid, friendID)
+}
+
+func (m *FileUserManager) DelUserFriend(userid, friendID string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	err := m.UserManager.DelUserFriend(userid, friendID)
+	if err != nil {
+		return err
+	}
+	return m.persistBoth(userid, friendID)
+}
+
+func (m *FileUserManager) AddFriendRequest(from, to string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	err := m.UserManager.AddFriendRequest(from, to)
+	if err != nil {
+		return err
+	}
+	return m.persistBoth(from, to)
+}
+
+func (m *FileUserManager) DelFriendRequest(from, to string) (bool, error) {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	existed, err := m.UserManager.DelFriendRequest(from, to)
+	if err != nil || !existed {
+		return existed, err
+	}
+	return existed, m.persistBoth(from, to)
+}
+
+func (m *FileUserManager) Block(userid, target string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	err := m.UserManager.Block(userid, target)
+	if err != nil {
+		return err
+	}
+	return m.persistBoth(userid, target)
+}
+
+func (m *FileUserManager) Unblock(userid, target string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	err := m.UserManager.Unblock(userid, target)
+	if err != nil {
+		return err
+	}
+	return m.persist(userOpPut, userid)
+}
+
+func (m *FileUserManager) RevokeToken(id string, expiry int64) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	err := m.UserManager.RevokeToken(id, expiry)
+	if err != nil {
+		return err
+	}
+	rec, err := encodeUserEntry(userEntry{Op: userOpRevoke, ID: id, Expiry: expiry})
+	if err != nil {
+		return err
+	}
+	return m.store.append(rec)
+}
+
+func (m *FileUserManager) Close() error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return m.store.close()
+}
+
+// persistBoth logs both users of a relation between them; either one may be
+// gone already.
+func (m *FileUserManager) persistBoth(userid, otherID string) error {
+	for _, id := range []string{userid, otherID} {
+		err := m.persist(userOpPut, id)
+		if err != nil && err != ErrNotFoundUser {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *FileUserManager) persist(op byte, id string) error {
+	e := userEntry{Op: op, ID: id}
+	if op == userOpPut {
+		m.mu.RLock()
+		u, ok := m.users[id]
+		if ok {
+			e.Record = u.Record()
+		}
+		m.mu.RUnlock()
+		if !ok {
+			return ErrNotFoundUser
+		}
+	}
+	rec, err := encodeUserEntry(e)
+	if err != nil {
+		return err
+	}
+	return m.store.append(rec)
+}
+
+func (m *FileUserManager) records() ([][]byte, error) {
+	m.mu.RLock()
+	records := make([][]byte, 0, len(m.users))
+	for id, u := range m.users {
+		rec, err := encodeUserEntry(userEntry{Op: userOpPut, ID: id, Record: u.Record()})
+		if err != nil {
+			m.mu.RUnlock()
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	m.mu.RUnlock()
+	for id, expiry := range m.RevokedTokens() {
+		rec, err := encodeUserEntry(userEntry{Op: userOpRevoke, ID: id, Expiry: expiry})
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func encodeUserEntry(e userEntry) ([]byte, error) {
+	var buf = &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(&e)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,214 @@
+package repo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	recordHeaderSize = 8
+	maxRecordSize    = 64 << 20
+)
+
+var errTornRecord = errors.New("torn record")
+
+// fileStore keeps a snapshot file plus an append-only log of the changes made
+// since the snapshot was taken. Each record is written as its length, its
+// crc32 and the payload, and every append is synced before it returns. A torn
+// record at the end of the log, left by a crash in the middle of an append,
+// is dropped when the store is loaded.
+//
+// A snapshot is taken every snapshotEvery appends and when the store is
+// closed, so that the next start does not need to replay the log. A crash
+// between writing a new snapshot and emptying the log replays the old log on
+// top of the new snapshot, so applying a record twice must be harmless.
+type fileStore struct {
+	dir           string
+	snapPath      string
+	logPath       string
+	log           *os.File
+	appended      int
+	snapshotEvery int
+	// records returns the current state as records for a snapshot, it is nil
+	// for a store that never takes one.
+	records func() ([][]byte, error)
+}
+
+func openFileStore(dir, name string, snapshotEvery int) (*fileStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{
+		dir:           dir,
+		snapPath:      filepath.Join(dir, name+".snap"),
+		logPath:       filepath.Join(dir, name+".log"),
+		snapshotEvery: snapshotEvery,
+	}, nil
+}
+
+// load replays the snapshot and then the log through apply and opens the log
+// for appending. Later snapshots are made of what records returns.
+func (s *fileStore) load(apply func(rec []byte) error, records func() ([][]byte, error)) error {
+	s.records = records
+	_, err := replay(s.snapPath, apply)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("load snapshot %s failed, err: %w", s.snapPath, err)
+	}
+	good, err := replay(s.logPath, apply)
+	if err != nil && !os.IsNotExist(err) && !errors.Is(err, errTornRecord) {
+		return fmt.Errorf("load log %s failed, err: %w", s.logPath, err)
+	}
+	f, err := os.OpenFile(s.logPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(good); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err = f.Seek(good, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+	s.log = f
+	return nil
+}
+
+// append writes rec to the log and takes a snapshot once enough records
+// have been appended since the last one.
+func (s *fileStore) append(rec []byte) error {
+	if _, err := s.log.Write(frameRecord(nil, rec)); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.appended++
+	if s.snapshotEvery <= 0 || s.appended < s.snapshotEvery {
+		return nil
+	}
+	return s.snapshot()
+}
+
+// snapshot atomically replaces the snapshot with the current records and
+// empties the log.
+func (s *fileStore) snapshot() error {
+	if s.records == nil {
+		return nil
+	}
+	records, err := s.records()
+	if err != nil {
+		return err
+	}
+	tmp := s.snapPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, rec := range records {
+		if _, err = w.Write(frameRecord(nil, rec)); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.snapPath); err != nil {
+		return err
+	}
+	syncDir(s.dir)
+
+	if err = s.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.appended = 0
+	return s.log.Sync()
+}
+
+func (s *fileStore) close() error {
+	if s.log == nil {
+		return nil
+	}
+	err := s.snapshot()
+	if err != nil {
+		return err
+	}
+	return s.log.Close()
+}
+
+func frameRecord(buf, rec []byte) []byte {
+	var head [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(head[:4], uint32(len(rec)))
+	binary.BigEndian.PutUint32(head[4:], crc32.ChecksumIEEE(rec))
+	buf = append(buf, head[:]...)
+	return append(buf, rec...)
+}
+
+// replay applies every record of the file at path and returns the offset just
+// past the last intact record.
+func replay(path string, apply func(rec []byte) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var (
+		r    = bufio.NewReader(f)
+		good int64
+		head [recordHeaderSize]byte
+	)
+	for {
+		_, err = io.ReadFull(r, head[:])
+		if err == io.EOF {
+			return good, nil
+		}
+		if err != nil {
+			return good, errTornRecord
+		}
+		size := binary.BigEndian.Uint32(head[:4])
+		if size > maxRecordSize {
+			return good, errTornRecord
+		}
+		rec := make([]byte, size)
+		if _, err = io.ReadFull(r, rec); err != nil {
+			return good, errTornRecord
+		}
+		if crc32.ChecksumIEEE(rec) != binary.BigEndian.Uint32(head[4:]) {
+			return good, errTornRecord
+		}
+		if err = apply(rec); err != nil {
+			return good, err
+		}
+		good += int64(recordHeaderSize + len(rec))
+	}
+}
+
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
@@ -0,0 +1,227 @@
+package repo
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testState is a set of keys, changed by records "+key" and "-key".
+type testState struct {
+	keys map[string]bool
+}
+
+func (st *testState) apply(rec []byte) error {
+	key := string(rec[1:])
+	if rec[0] == '+' {
+		st.keys[key] = true
+	} else {
+		delete(st.keys, key)
+	}
+	return nil
+}
+
+func (st *testState) records() ([][]byte, error) {
+	var records [][]byte
+	for key := range st.keys {
+		records = append(records, []byte("+"+key))
+	}
+	return records, nil
+}
+
+func (st *testState) sorted() []string {
+	res := make([]string, 0, len(st.keys))
+	for key := range st.keys {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func openTestStore(t *testing.T, dir string, snapshotEvery int) (*fileStore, *testState) {
+	t.Helper()
+	s, err := openFileStore(dir, "test", snapshotEvery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &testState{keys: make(map[string]bool)}
+	if err = s.load(st.apply, st.records); err != nil {
+		t.Fatal(err)
+	}
+	return s, st
+}
+
+// change applies rec to st and appends it to s, like the file repos do.
+func change(t *testing.T, s *fileStore, st *testState, rec string) {
+	t.Helper()
+	if err := st.apply([]byte(rec)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.append([]byte(rec)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// crash drops s without the final snapshot of close.
+func crash(t *testing.T, s *fileStore) {
+	t.Helper()
+	if err := s.log.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestFileStoreReplayAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	s, st := openTestStore(t, dir, 0)
+	for _, rec := range []string{"+a", "+b", "+c", "-b"} {
+		change(t, s, st, rec)
+	}
+	crash(t, s)
+
+	s, got := openTestStore(t, dir, 0)
+	defer s.close()
+	if want := []string{"a", "c"}; !reflect.DeepEqual(got.sorted(), want) {
+		t.Fatalf("got %v, want %v", got.sorted(), want)
+	}
+}
+
+func TestFileStoreTruncatesTail(t *testing.T) {
+	cases := []struct {
+		name string
+		// damage breaks the log, whose last record starts at last
+		damage func(t *testing.T, path string, last int64)
+	}{
+		{"torn header", func(t *testing.T, path string, last int64) {
+			if err := os.Truncate(path, last+recordHeaderSize/2); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"torn payload", func(t *testing.T, path string, last int64) {
+			if err := os.Truncate(path, fileSize(t, path)-1); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"corrupt payload", func(t *testing.T, path string, last int64) {
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err = f.WriteAt([]byte("x"), last+recordHeaderSize+1); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"absurd length", func(t *testing.T, path string, last int64) {
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, last); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, st := openTestStore(t, dir, 0)
+			change(t, s, st, "+a")
+			change(t, s, st, "+b")
+			last := fileSize(t, s.logPath)
+			change(t, s, st, "+c")
+			crash(t, s)
+			c.damage(t, s.logPath, last)
+
+			s, got := openTestStore(t, dir, 0)
+			if want := []string{"a", "b"}; !reflect.DeepEqual(got.sorted(), want) {
+				t.Fatalf("got %v, want %v", got.sorted(), want)
+			}
+			if size := fileSize(t, s.logPath); size != last {
+				t.Fatalf("log is %d bytes after load, want %d", size, last)
+			}
+
+			// appends go after the last intact record
+			change(t, s, got, "+d")
+			crash(t, s)
+			s, got = openTestStore(t, dir, 0)
+			defer s.close()
+			if want := []string{"a", "b", "d"}; !reflect.DeepEqual(got.sorted(), want) {
+				t.Fatalf("after append got %v, want %v", got.sorted(), want)
+			}
+		})
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, st := openTestStore(t, dir, 3)
+	for _, rec := range []string{"+a", "+b", "-a", "+c", "+d"} {
+		change(t, s, st, rec)
+	}
+	// the third append took a snapshot of {b} and emptied the log
+	var logged []string
+	if _, err := replay(s.logPath, func(rec []byte) error {
+		logged = append(logged, string(rec))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"+c", "+d"}; !reflect.DeepEqual(logged, want) {
+		t.Fatalf("log holds %v, want %v", logged, want)
+	}
+	crash(t, s)
+
+	s, got := openTestStore(t, dir, 3)
+	if want := []string{"b", "c", "d"}; !reflect.DeepEqual(got.sorted(), want) {
+		t.Fatalf("got %v, want %v", got.sorted(), want)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(t, s.logPath); size != 0 {
+		t.Fatalf("log is %d bytes after close, want 0", size)
+	}
+
+	s, got = openTestStore(t, dir, 3)
+	defer s.close()
+	if want := []string{"b", "c", "d"}; !reflect.DeepEqual(got.sorted(), want) {
+		t.Fatalf("after close got %v, want %v", got.sorted(), want)
+	}
+}
+
+// A crash after a snapshot was written but before the log was emptied
+// replays the old log on top of the snapshot.
+func TestFileStoreReplaysLogOverSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s, st := openTestStore(t, dir, 0)
+	for _, rec := range []string{"+a", "+b", "-a"} {
+		change(t, s, st, rec)
+	}
+	stale, err := os.ReadFile(s.logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(s.logPath, stale, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, got := openTestStore(t, dir, 0)
+	defer s.close()
+	if want := []string{"b"}; !reflect.DeepEqual(got.sorted(), want) {
+		t.Fatalf("got %v, want %v", got.sorted(), want)
+	}
+}
@@ -0,0 +1,143 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/byronzhu-haha/chat/entity/group"
+	"github.com/byronzhu-haha/chat/server/config"
+	"sync"
+)
+
+type GroupRepo interface {
+	Create(g *group.Group) error
+	Get(id string) (group.BriefGroup, error)
+	IsMember(groupID, userid string) (bool, error)
+	Members(groupID string) ([]string, error)
+	AddMember(groupID, userid string) error
+	// DelMember removes userid from the group and deletes the group once
+	// its last member is gone.
+	DelMember(groupID, userid string) error
+	// DelUser removes userid from every group it is a member of, as
+	// DelMember does, once the user is deleted.
+	DelUser(userid string) error
+	Close() error
+}
+
+var (
+	ErrNotFoundGroup = errors.New("not found group")
+)
+
+// NewGroupRepo builds the group repo selected by the Storage of cfg.
+func NewGroupRepo(cfg *config.Config) (GroupRepo, error) {
+	switch cfg.Storage {
+	case StorageMemory, "":
+		return NewGroupManager(), nil
+	case StorageFile:
+		return NewFileGroupManager(cfg.DataDir, cfg.SnapshotEvery)
+	}
+	return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+}
+
+type GroupManager struct {
+	groups map[string]*group.Group
+	mu     sync.RWMutex
+}
+
+func NewGroupManager() *GroupManager {
+	return &GroupManager{
+		groups: make(map[string]*group.Group),
+	}
+}
+
+func (m *GroupManager) Create(g *group.Group) error {
+	if g == nil {
+		return errors.New("group is nil")
+	}
+	m.mu.Lock()
+	m.groups[g.ID()] = g
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *GroupManager) Get(id string) (group.BriefGroup, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	g, ok := m.groups[id]
+	if !ok {
+		return group.BriefGroup{}, ErrNotFoundGroup
+	}
+	return g.Brief(), nil
+}
+
+func (m *GroupManager) IsMember(groupID, userid string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	g, ok := m.groups[groupID]
+	if !ok {
+		return false, ErrNotFoundGroup
+	}
+	return g.IsMember(userid), nil
+}
+
+func (m *GroupManager) Members(groupID string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	g, ok := m.groups[groupID]
+	if !ok {
+		return nil, ErrNotFoundGroup
+	}
+	return g.Members(), nil
+}
+
+func (m *GroupManager) AddMember(groupID, userid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[groupID]
+	if !ok {
+		return ErrNotFoundGroup
+	}
+	g.AddMember(userid)
+	return nil
+}
+
+func (m *GroupManager) DelMember(groupID, userid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.groups[groupID]
+	if !ok {
+		return ErrNotFoundGroup
+	}
+	g.DelMember(userid)
+	if g.Empty() {
+		delete(m.groups, groupID)
+	}
+	return nil
+}
+
+func (m *GroupManager) DelUser(userid string) error {
+	m.delUser(userid)
+	return nil
+}
+
+// delUser removes userid from its groups and returns the ids of the groups
+// that changed.
+func (m *GroupManager) delUser(userid string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var changed []string
+	for id, g := range m.groups {
+		if !g.IsMember(userid) {
+			continue
+		}
+		g.DelMember(userid)
+		if g.Empty() {
+			delete(m.groups, id)
+		}
+		changed = append(changed, id)
+	}
+	return changed
+}
+
+func (m *GroupManager) Close() error {
+	return nil
+}
@@ -0,0 +1,177 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/server/config"
+	"sort"
+	"sync"
+)
+
+// History keeps every chat message accepted by the server, grouped by
+// conversation.
+type History interface {
+	// Append assigns the next message id and the current time to rec and
+	// stores it.
+	Append(rec message.ChatRecord) (message.ChatRecord, error)
+	// Query returns up to limit messages of the conversation, oldest first.
+	// With afterID set they are the first messages after it, otherwise the
+	// last ones before beforeID, or before the end if beforeID is 0. It
+	// reports whether more messages lie beyond the page.
+	Query(conversation string, beforeID, afterID int64, limit int) ([]message.ChatRecord, bool, error)
+	Get(id int64) (message.ChatRecord, error)
+	// Sent returns the id of the message userid sent with clientMsgID, if it
+	// is one of their latest SentKept messages.
+	Sent(userid, clientMsgID string) (int64, bool)
+	Close() error
+}
+
+// SentKept is how many of the latest messages of a user History remembers
+// by their ClientMsgID.
+const SentKept = 256
+
+// UserConversation names the conversation between two users, the same for
+// both of them.
+func UserConversation(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return "u:" + a + ":" + b
+}
+
+func GroupConversation(groupID string) string {
+	return "g:" + groupID
+}
+
+// ConversationOf names the conversation rec belongs to.
+func ConversationOf(rec message.ChatRecord) string {
+	if rec.DestGroupID != "" {
+		return GroupConversation(rec.DestGroupID)
+	}
+	return UserConversation(rec.SrcUserID, rec.DestUserID)
+}
+
+// NewHistory builds the history store selected by the Storage of cfg.
+func NewHistory(cfg *config.Config) (History, error) {
+	switch cfg.Storage {
+	case StorageMemory, "":
+		return NewMemoryHistory(), nil
+	case StorageFile:
+		return NewFileHistory(cfg.DataDir)
+	}
+	return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+}
+
+var ErrNotFoundMessage = errors.New("not found message")
+
+type MemoryHistory struct {
+	mu     sync.RWMutex
+	lastID int64
+	convs  map[string][]message.ChatRecord
+	// conversation of every message by id
+	index map[int64]string
+	sent  map[string]*sentChats
+}
+
+// sentChats maps the client ids of the latest messages of a user to their
+// ids.
+type sentChats struct {
+	ids   map[string]int64
+	order []string
+}
+
+func NewMemoryHistory() *MemoryHistory {
+	return &MemoryHistory{
+		convs: make(map[string][]message.ChatRecord),
+		index: make(map[int64]string),
+		sent:  make(map[string]*sentChats),
+	}
+}
+
+func (h *MemoryHistory) Append(rec message.ChatRecord) (message.ChatRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	rec.ID = h.lastID
+	rec.Time = nowMilli()
+	h.add(rec)
+	return rec, nil
+}
+
+func (h *MemoryHistory) add(rec message.ChatRecord) {
+	conv := ConversationOf(rec)
+	h.convs[conv] = append(h.convs[conv], rec)
+	h.index[rec.ID] = conv
+	if rec.ID > h.lastID {
+		h.lastID = rec.ID
+	}
+	if rec.ClientMsgID != "" {
+		h.rememberSent(rec)
+	}
+}
+
+func (h *MemoryHistory) rememberSent(rec message.ChatRecord) {
+	sc, ok := h.sent[rec.SrcUserID]
+	if !ok {
+		sc = &sentChats{ids: make(map[string]int64)}
+		h.sent[rec.SrcUserID] = sc
+	}
+	if len(sc.order) >= SentKept {
+		delete(sc.ids, sc.order[0])
+		sc.order = sc.order[1:]
+	}
+	sc.ids[rec.ClientMsgID] = rec.ID
+	sc.order = append(sc.order, rec.ClientMsgID)
+}
+
+func (h *MemoryHistory) Query(conversation string, beforeID, afterID int64, limit int) ([]message.ChatRecord, bool, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	recs := h.convs[conversation]
+	if afterID > 0 {
+		i := sort.Search(len(recs), func(i int) bool { return recs[i].ID > afterID })
+		recs = recs[i:]
+		more := len(recs) > limit
+		if more {
+			recs = recs[:limit]
+		}
+		return append([]message.ChatRecord(nil), recs...), more, nil
+	}
+	if beforeID > 0 {
+		i := sort.Search(len(recs), func(i int) bool { return recs[i].ID >= beforeID })
+		recs = recs[:i]
+	}
+	more := len(recs) > limit
+	if more {
+		recs = recs[len(recs)-limit:]
+	}
+	return append([]message.ChatRecord(nil), recs...), more, nil
+}
+
+func (h *MemoryHistory) Get(id int64) (message.ChatRecord, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	conv, ok := h.index[id]
+	if !ok {
+		return message.ChatRecord{}, ErrNotFoundMessage
+	}
+	recs := h.convs[conv]
+	i := sort.Search(len(recs), func(i int) bool { return recs[i].ID >= id })
+	return recs[i], nil
+}
+
+func (h *MemoryHistory) Sent(userid, clientMsgID string) (int64, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	sc, ok := h.sent[userid]
+	if !ok {
+		return 0, false
+	}
+	id, ok := sc.ids[clientMsgID]
+	return id, ok
+}
+
+func (h *MemoryHistory) Close() error {
+	return nil
+}
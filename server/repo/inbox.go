@@ -0,0 +1,97 @@
+package repo
+
+import (
+	"fmt"
+	"github.com/byronzhu-haha/chat/entity/message"
+	"github.com/byronzhu-haha/chat/server/config"
+	"github.com/byronzhu-haha/log"
+	"sync"
+	"time"
+)
+
+// Inbox queues chat messages per user until they are drained, in the order
+// they were pushed.
+type Inbox interface {
+	Push(userid string, msg message.ChatRecord) error
+	Drain(userid string) ([]message.ChatRecord, error)
+	Close() error
+}
+
+// NewInbox builds the offline inbox selected by the Storage of cfg.
+func NewInbox(cfg *config.Config) (Inbox, error) {
+	switch cfg.Storage {
+	case StorageMemory, "":
+		return NewMemoryInbox(cfg.InboxMaxMessages, cfg.InboxLifetime()), nil
+	case StorageFile:
+		return NewFileInbox(cfg.DataDir, cfg.SnapshotEvery, cfg.InboxMaxMessages, cfg.InboxLifetime())
+	}
+	return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+}
+
+// MemoryInbox keeps at most max messages per user, dropping the oldest ones
+// beyond that, and forgets messages older than ttl. A zero max or ttl means
+// no limit.
+type MemoryInbox struct {
+	mu    sync.Mutex
+	boxes map[string][]message.ChatRecord
+	max   int
+	ttl   time.Duration
+}
+
+func NewMemoryInbox(max int, ttl time.Duration) *MemoryInbox {
+	return &MemoryInbox{
+		boxes: make(map[string][]message.ChatRecord),
+		max:   max,
+		ttl:   ttl,
+	}
+}
+
+func (b *MemoryInbox) Push(userid string, msg message.ChatRecord) error {
+	b.mu.Lock()
+	b.push(userid, msg)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *MemoryInbox) push(userid string, msg message.ChatRecord) {
+	box := b.expire(b.boxes[userid], nowMilli())
+	box = append(box, msg)
+	if b.max > 0 && len(box) > b.max {
+		log.Warnf("inbox of user(%s) is full, drop %d oldest message(s)", userid, len(box)-b.max)
+		box = append(box[:0:0], box[len(box)-b.max:]...)
+	}
+	b.boxes[userid] = box
+}
+
+func (b *MemoryInbox) Drain(userid string) ([]message.ChatRecord, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.drain(userid), nil
+}
+
+func (b *MemoryInbox) drain(userid string) []message.ChatRecord {
+	box := b.expire(b.boxes[userid], nowMilli())
+	delete(b.boxes, userid)
+	return box
+}
+
+func (b *MemoryInbox) Close() error {
+	return nil
+}
+
+// expire drops the leading messages of box that are older than the ttl;
+// messages are pushed in time order so the rest are younger.
+func (b *MemoryInbox) expire(box []message.ChatRecord, now int64) []message.ChatRecord {
+	if b.ttl <= 0 {
+		return box
+	}
+	i := 0
+	for i < len(box) && time.Duration(now-box[i].Time)*time.Millisecond > b.ttl {
+		i++
+	}
+	return box[i:]
+}
+
+func nowMilli() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
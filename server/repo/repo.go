@@ -2,11 +2,14 @@ package repo
 
 import (
 	"errors"
+	"fmt"
 	"github.com/byronzhu-haha/chat/entity/user"
-	"regexp"
+	"github.com/byronzhu-haha/chat/server/config"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Repo interface {
@@ -14,14 +17,30 @@ type Repo interface {
 	Get(id string) (*user.User, error)
 	Del(id string) error
 	List(username string) ([]*user.User, error)
+	// DelUserFriend and AddUserFriend change the friendship of both users.
 	DelUserFriend(userid, friendID string) error
 	AddUserFriend(userid, friendID string) error
+	// AddFriendRequest records a pending friend request of from to to.
+	AddFriendRequest(from, to string) error
+	// DelFriendRequest drops the pending friend request of from to to and
+	// reports whether there was one.
+	DelFriendRequest(from, to string) (bool, error)
+	// ListFriendRequest returns the users who asked userid to be friends
+	// and those userid asked.
+	ListFriendRequest(userid string) (in, out []user.BriefUser)
+	// Block adds target to the block list of userid, ending their
+	// friendship and the pending friend requests between them.
+	Block(userid, target string) error
+	Unblock(userid, target string) error
 	ListUserFriend(userid string) []user.BriefUser
-}
-
-type UserIPRepo interface {
-	SetUserIP(uid, ip string) error
-	GetUserIP(uid string) (string, error)
+	// ListUserFollower returns the ids of the users who have userid in
+	// their friend list.
+	ListUserFollower(userid string) []string
+	// RevokeToken records the id of a revoked session token until its
+	// expiry in unix seconds, RevokedTokens returns those not expired yet.
+	RevokeToken(id string, expiry int64) error
+	RevokedTokens() map[string]int64
+	Close() error
 }
 
 var (
@@ -29,13 +48,31 @@ var (
 )
 
 type UserManager struct {
-	users map[string]*user.User
-	mu    sync.RWMutex
+	users   map[string]*user.User
+	revoked map[string]int64
+	mu      sync.RWMutex
+}
+
+const (
+	StorageMemory = "memory"
+	StorageFile   = "file"
+)
+
+// NewRepo builds the user repo selected by the Storage of cfg.
+func NewRepo(cfg *config.Config) (Repo, error) {
+	switch cfg.Storage {
+	case StorageMemory, "":
+		return NewUserManager(), nil
+	case StorageFile:
+		return NewFileUserManager(cfg.DataDir, cfg.SnapshotEvery)
+	}
+	return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
 }
 
 func NewUserManager() Repo {
 	return &UserManager{
-		users: make(map[string]*user.User),
+		users:   make(map[string]*user.User),
+		revoked: make(map[string]int64),
 	}
 }
 
@@ -61,12 +98,9 @@ func (m *UserManager) Get(id string) (*user.User, error) {
 }
 
 func (m *UserManager) List(username string) (res []*user.User, err error) {
-	var (
-		reg = regexp.MustCompile("*"+username+"*")
-	)
 	m.mu.RLock()
 	for _, u := range m.users {
-		if reg.MatchString(u.Name()) {
+		if strings.Contains(u.Name(), username) {
 			res = append(res, u)
 		}
 	}
@@ -78,10 +112,41 @@ func (m *UserManager) List(username string) (res []*user.User, err error) {
 }
 
 func (m *UserManager) Del(id string) error {
+	m.del(id)
+	return nil
+}
+
+// del deletes the user id along with its friendships and pending friend
+// requests, and returns the ids of the other users that changed.
+func (m *UserManager) del(id string) []string {
 	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil
+	}
 	delete(m.users, id)
-	m.mu.Unlock()
-	return nil
+	var changed []string
+	for _, f := range u.ListFriend() {
+		if o, ok := m.users[f.ID]; ok {
+			o.DelFriend(id)
+			changed = append(changed, f.ID)
+		}
+	}
+	in, out := u.ListRequest()
+	for _, from := range in {
+		if o, ok := m.users[from]; ok {
+			o.DelRequestOut(id)
+			changed = append(changed, from)
+		}
+	}
+	for _, to := range out {
+		if o, ok := m.users[to]; ok {
+			o.DelRequestIn(id)
+			changed = append(changed, to)
+		}
+	}
+	return changed
 }
 
 func (m *UserManager) AddUserFriend(userid, friendID string) error {
@@ -97,6 +162,7 @@ func (m *UserManager) AddUserFriend(userid, friendID string) error {
 		return ErrNotFoundUser
 	}
 	u.AddFriend(friendID, f.Name())
+	f.AddFriend(userid, u.Name())
 	m.mu.Unlock()
 	return nil
 }
@@ -109,10 +175,105 @@ func (m *UserManager) DelUserFriend(userid, friendID string) error {
 		return ErrNotFoundUser
 	}
 	u.DelFriend(friendID)
+	if f, ok := m.users[friendID]; ok {
+		f.DelFriend(userid)
+	}
 	m.mu.Unlock()
 	return nil
 }
 
+func (m *UserManager) AddFriendRequest(from, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.users[from]
+	if !ok {
+		return ErrNotFoundUser
+	}
+	t, ok := m.users[to]
+	if !ok {
+		return ErrNotFoundUser
+	}
+	f.AddRequestOut(to)
+	t.AddRequestIn(from)
+	return nil
+}
+
+func (m *UserManager) DelFriendRequest(from, to string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, fok := m.users[from]
+	t, tok := m.users[to]
+	if !fok && !tok {
+		return false, ErrNotFoundUser
+	}
+	// either side may be gone, the other one is dropped anyway
+	existed := false
+	if fok {
+		existed = f.HasRequestOut(to)
+		f.DelRequestOut(to)
+	}
+	if tok {
+		existed = existed || t.HasRequestIn(from)
+		t.DelRequestIn(from)
+	}
+	return existed, nil
+}
+
+func (m *UserManager) ListFriendRequest(userid string) (in, out []user.BriefUser) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.users[userid]
+	if !ok {
+		return nil, nil
+	}
+	inIDs, outIDs := u.ListRequest()
+	return m.briefs(userid, inIDs), m.briefs(userid, outIDs)
+}
+
+func (m *UserManager) Block(userid, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userid]
+	if !ok {
+		return ErrNotFoundUser
+	}
+	t, ok := m.users[target]
+	if !ok {
+		return ErrNotFoundUser
+	}
+	u.Block(target)
+	u.DelFriend(target)
+	t.DelFriend(userid)
+	u.DelRequestIn(target)
+	u.DelRequestOut(target)
+	t.DelRequestIn(userid)
+	t.DelRequestOut(userid)
+	return nil
+}
+
+func (m *UserManager) Unblock(userid, target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userid]
+	if !ok {
+		return ErrNotFoundUser
+	}
+	u.Unblock(target)
+	return nil
+}
+
+// briefs returns the users of ids as seen by viewer; it must be called with
+// mu held.
+func (m *UserManager) briefs(viewer string, ids []string) []user.BriefUser {
+	res := make([]user.BriefUser, 0, len(ids))
+	for _, id := range ids {
+		if u, ok := m.users[id]; ok {
+			res = append(res, u.BriefFor(viewer))
+		}
+	}
+	return res
+}
+
 func (m *UserManager) ListUserFriend(userid string) []user.BriefUser {
 	m.mu.RLock()
 	u, ok := m.users[userid]
@@ -126,71 +287,57 @@ func (m *UserManager) ListUserFriend(userid string) []user.BriefUser {
 		if !ok {
 			continue
 		}
-		res[i].State = f.State()
+		res[i] = f.BriefFor(userid)
 	}
 	u.SortFriend(res)
 	m.mu.RUnlock()
 	return res
 }
 
-type UserIPManager struct {
-	init bool
-	ips  map[string]string
-	mu   sync.RWMutex
-}
-
-var ipMgr UserIPRepo
-
-func init() {
-	ipMgr = &UserIPManager{
-		ips: map[string]string{},
+// ListUserFollower returns the friends of userid, friendship goes both ways.
+func (m *UserManager) ListUserFollower(userid string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.users[userid]
+	if !ok {
+		return nil
 	}
-}
-
-func SetUserIP(uid, ip string) error {
-	return ipMgr.SetUserIP(uid, ip)
-}
-
-func GetUserIP(uid string) (string, error) {
-	return ipMgr.GetUserIP(uid)
-}
-
-func (m *UserIPManager) wrap(fn func()) {
-	if !m.init {
-		panic("ip manager is not init")
+	friends := u.ListFriend()
+	res := make([]string, 0, len(friends))
+	for _, f := range friends {
+		res = append(res, f.ID)
 	}
-	fn()
+	return res
 }
 
-func (m *UserIPManager) SetUserIP(uid, ip string) (err error) {
-	m.wrap(func() {
-		if uid == "" || ip == "" {
-			err = errors.New("uid or ip must not be nil")
-			return
+func (m *UserManager) RevokeToken(id string, expiry int64) error {
+	now := time.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, exp := range m.revoked {
+		if now > exp {
+			delete(m.revoked, k)
 		}
-		m.mu.Lock()
-		m.ips[uid] = ip
-		m.mu.Unlock()
-	})
+	}
+	m.revoked[id] = expiry
 	return nil
 }
 
-func (m *UserIPManager) GetUserIP(uid string) (ip string, err error) {
-	m.wrap(func() {
-		if uid == "" {
-			err = errors.New("uid must not be nil")
-			return
-		}
-		m.mu.RLock()
-		res, ok := m.ips[uid]
-		m.mu.RUnlock()
-		if !ok {
-			err = errors.New("not found ip")
-			return
+func (m *UserManager) RevokedTokens() map[string]int64 {
+	now := time.Now().Unix()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	res := make(map[string]int64, len(m.revoked))
+	for id, exp := range m.revoked {
+		if now <= exp {
+			res[id] = exp
 		}
-		ip = res
-	})
-	return ip, nil
+	}
+	return res
+}
+
+func (m *UserManager) Close() error {
+	return nil
 }
 
 var idGenerator uint64
@@ -199,3 +346,18 @@ func GenerateOneID() string {
 	n := atomic.AddUint64(&idGenerator, 100000)
 	return strconv.FormatUint(n, 10)
 }
+
+// observeID moves the generator past id, so that ids loaded from disk are
+// not handed out again.
+func observeID(id string) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return
+	}
+	for {
+		cur := atomic.LoadUint64(&idGenerator)
+		if n <= cur || atomic.CompareAndSwapUint64(&idGenerator, cur, n) {
+			return
+		}
+	}
+}
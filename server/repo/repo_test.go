@@ -0,0 +1,161 @@
+package repo
+
+import (
+	"github.com/byronzhu-haha/chat/entity/group"
+	"github.com/byronzhu-haha/chat/entity/user"
+	"testing"
+)
+
+// relate saves alice, bob, carol and dave, makes alice and bob friends and
+// leaves friend requests from carol to alice and from alice to dave.
+func relate(t *testing.T, m Repo) {
+	t.Helper()
+	for _, id := range []string{"alice", "bob", "carol", "dave"} {
+		if err := m.Save(user.NewUser(id, id, "", user.Offline)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.AddUserFriend("alice", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddFriendRequest("carol", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddFriendRequest("alice", "dave"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkDeleted checks that nothing in m points at alice any more.
+func checkDeleted(t *testing.T, m Repo) {
+	t.Helper()
+	if _, err := m.Get("alice"); err != ErrNotFoundUser {
+		t.Fatalf("get deleted user, err: %v", err)
+	}
+	for _, id := range []string{"bob", "carol", "dave"} {
+		u, err := m.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in, out := u.ListRequest()
+		if u.HasFriend("alice") || len(in) != 0 || len(out) != 0 {
+			t.Fatalf("%s still has friend alice %v, requests %v %v", id, u.HasFriend("alice"), in, out)
+		}
+	}
+}
+
+func TestDelUser(t *testing.T) {
+	m := NewUserManager()
+	relate(t, m)
+	if err := m.Del("alice"); err != nil {
+		t.Fatal(err)
+	}
+	checkDeleted(t, m)
+	if err := m.Del("alice"); err != nil {
+		t.Fatalf("delete user twice, err: %v", err)
+	}
+}
+
+func TestFileDelUser(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewFileUserManager(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relate(t, m)
+	if err = m.Del("alice"); err != nil {
+		t.Fatal(err)
+	}
+	checkDeleted(t, m)
+	crash(t, m.store)
+
+	// the log replays to the same state, and so does the snapshot
+	for i := 0; i < 2; i++ {
+		m, err = NewFileUserManager(dir, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDeleted(t, m)
+		if err = m.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDelFriendRequestOfDeletedUser(t *testing.T) {
+	m := NewUserManager().(*UserManager)
+	relate(t, m)
+	// the request is left on one side only, as by a deletion before the
+	// requests were cleaned up along with the user
+	m.mu.Lock()
+	delete(m.users, "carol")
+	m.mu.Unlock()
+
+	existed, err := m.DelFriendRequest("carol", "alice")
+	if err != nil || !existed {
+		t.Fatalf("drop request of deleted user: existed %v, err: %v", existed, err)
+	}
+	u, _ := m.Get("alice")
+	if in, _ := u.ListRequest(); len(in) != 0 {
+		t.Fatalf("alice still has requests from %v", in)
+	}
+	if _, err = m.DelFriendRequest("carol", "nobody"); err != ErrNotFoundUser {
+		t.Fatalf("drop request between unknown users, err: %v", err)
+	}
+}
+
+func TestGroupDelUser(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewFileGroupManager(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []*group.Group{
+		group.NewGroup("shared", "shared", group.Private, "alice"),
+		group.NewGroup("alone", "alone", group.Room, "alice"),
+		group.NewGroup("other", "other", group.Room, "bob"),
+	} {
+		if err = m.Create(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = m.AddMember("shared", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.DelUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = NewFileGroupManager(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if members, err := m.Members("shared"); err != nil || len(members) != 1 || members[0] != "bob" {
+		t.Fatalf("members of shared %v, err: %v", members, err)
+	}
+	if _, err = m.Get("alone"); err != ErrNotFoundGroup {
+		t.Fatalf("group left empty, err: %v", err)
+	}
+	if members, err := m.Members("other"); err != nil || len(members) != 1 {
+		t.Fatalf("members of other %v, err: %v", members, err)
+	}
+}
+
+func TestListUserFollower(t *testing.T) {
+	m := NewUserManager()
+	relate(t, m)
+	if got := m.ListUserFollower("alice"); len(got) != 1 || got[0] != "bob" {
+		t.Fatalf("followers of alice %v", got)
+	}
+	// a pending request does not make a follower
+	if got := m.ListUserFollower("dave"); len(got) != 0 {
+		t.Fatalf("followers of dave %v", got)
+	}
+	if got := m.ListUserFollower("nobody"); len(got) != 0 {
+		t.Fatalf("followers of unknown user %v", got)
+	}
+}
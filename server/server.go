@@ -2,9 +2,23 @@ package main
 
 import (
 	"github.com/byronzhu-haha/chat/server/cmd"
+	"github.com/byronzhu-haha/chat/server/config"
+	"github.com/byronzhu-haha/log"
+	"os"
 )
 
 func main() {
-	server := cmd.NewChatServer()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Errorf("load config failed, err: %+v", err)
+		os.Exit(1)
+	}
+	log.Infof("config: %s", cfg.String())
+
+	server, err := cmd.NewChatServer(cfg)
+	if err != nil {
+		log.Errorf("create server failed, err: %+v", err)
+		os.Exit(1)
+	}
 	server.Run()
 }